@@ -0,0 +1,264 @@
+package compress
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultAnimationWidth and defaultAnimationFPS are where Animate starts
+	// when Options.MaxWidth and MaxFPS are not set.
+	defaultAnimationWidth = 480
+	defaultAnimationFPS   = 15.0
+	// minAnimationWidth is the narrowest Animate makes an animation.
+	minAnimationWidth = 120
+	// maxAnimationAttempts bounds the encodes Animate tries.
+	maxAnimationAttempts = 10
+)
+
+var (
+	// animationFPS, gifColors and webpQualities are the steps Animate goes
+	// down while the output is too large.
+	animationFPS  = []float64{15, 12, 10, 8, 6}
+	gifColors     = []int{256, 128, 64, 32}
+	webpQualities = []int{75, 60, 45, 30}
+)
+
+// AnimationStep is one encode tried by Animate.
+type AnimationStep struct {
+	Attempt int
+	Width   int
+	FPS     float64
+	Colors  int // GIF palette size, 0 for WebP
+	Quality int // WebP quality, 0 for GIF
+	Size    int64
+}
+
+// IsAnimation reports whether output names an animated GIF or WebP, which
+// Compress produces with Animate.
+func IsAnimation(output string) bool {
+	ext := strings.ToLower(filepath.Ext(output))
+	return ext == ".gif" || ext == ".webp"
+}
+
+// Animate turns the selected range of opts.Input into an animated GIF or
+// WebP, depending on the extension of opts.Output, that fits in
+// opts.TargetMB. GIFs are encoded with a palette generated for the clip.
+// While the output is too large the width, frame rate and colours (or WebP
+// quality) are lowered in turn; every attempt is reported as an
+// EventAnimation. opts.MaxWidth and opts.MaxFPS set where it starts.
+func Animate(ctx context.Context, opts Options) (*Result, error) {
+	res, err := animate(ctx, opts)
+	return res, opts.logFailure(err)
+}
+
+func animate(ctx context.Context, opts Options) (*Result, error) {
+	if opts.TargetMB <= 0 || math.IsNaN(opts.TargetMB) || math.IsInf(opts.TargetMB, 0) {
+		return nil, ErrInvalidTarget
+	}
+	if opts.CRF != 0 || opts.MinSSIM != 0 {
+		return nil, fmt.Errorf("%w: animations are made to a target size", ErrInvalidTarget)
+	}
+	gif := strings.EqualFold(filepath.Ext(opts.Output), ".gif")
+
+	info, err := opts.probe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !info.HasVideo() {
+		return nil, fmt.Errorf("%w in %s", ErrNoVideo, opts.Input)
+	}
+	webpEncoder := ""
+	if !gif {
+		if webpEncoder, err = animatedWebPEncoder(ctx, opts); err != nil {
+			return nil, err
+		}
+	}
+	start, end, err := opts.Range(info.Duration)
+	if err != nil {
+		return nil, err
+	}
+	plan := Plan{
+		TargetMB: opts.TargetMB,
+		Start:    start,
+		End:      end,
+		Duration: end - start,
+		Trimmed:  start > 0 || end < info.Duration,
+		Passes:   1,
+	}
+
+	workDir, err := os.MkdirTemp(opts.TempDir, "mp4_compress-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating palette directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+	if opts.Input, err = absPath(opts.Input); err != nil {
+		return nil, err
+	}
+	output, err := absPath(opts.Output)
+	if err != nil {
+		return nil, err
+	}
+	partial, err := partialFile(output)
+	if err != nil {
+		return nil, fmt.Errorf("creating output: %w", err)
+	}
+	defer os.Remove(partial)
+
+	sourceWidth, _ := displaySize(info.Video[0])
+	step := AnimationStep{Width: min(sourceWidth, defaultAnimationWidth), FPS: defaultAnimationFPS}
+	if gif {
+		step.Colors = gifColors[0]
+	} else {
+		step.Quality = webpQualities[0]
+	}
+	if opts.MaxWidth > 0 {
+		step.Width = min(sourceWidth, opts.MaxWidth)
+	}
+	if opts.MaxFPS > 0 {
+		step.FPS = opts.MaxFPS
+	}
+	if src := info.Video[0].FPS; src > 0 {
+		step.FPS = math.Min(step.FPS, src)
+	}
+
+	res := &Result{Info: info, Output: output, Action: ActionEncode}
+	for step.Attempt = 1; ; step.Attempt++ {
+		plan.Width, plan.FPS = step.Width, step.FPS
+		filter := fmt.Sprintf("fps=%s,scale=%d:-1:flags=lanczos", formatRate(step.FPS), step.Width)
+		if gif {
+			err = encodeGIF(ctx, opts, plan, filter, step.Colors, workDir, partial)
+		} else {
+			err = encodeWebP(ctx, opts, plan, filter, webpEncoder, step.Quality, partial)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, fmt.Errorf("attempt %d failed: %w", step.Attempt, err)
+		}
+		stat, err := os.Stat(partial)
+		if err != nil {
+			return nil, fmt.Errorf("reading output: %w", err)
+		}
+		step.Size = stat.Size()
+		current := step
+		opts.emit(Event{Kind: EventAnimation, Animation: &current})
+
+		res.Size, res.Attempts, res.Animation = step.Size, step.Attempt, &current
+		res.OverTarget = step.Size > plan.TargetBytes()
+		if !res.OverTarget || step.Attempt >= maxAnimationAttempts || !step.shrink(gif, float64(plan.TargetBytes())/float64(step.Size)) {
+			break
+		}
+	}
+	res.Plan = plan
+	if res.OverTarget {
+		opts.emit(Event{Kind: EventWarning, Message: fmt.Sprintf(
+			"animation is still over %.2f MB at %dpx, %s fps", plan.TargetMB, plan.Width, formatRate(plan.FPS))})
+	}
+
+	if err := os.Rename(partial, output); err != nil {
+		return nil, fmt.Errorf("moving output into place: %w", err)
+	}
+	return res, nil
+}
+
+// shrink lowers one setting of s for the next attempt, taking turns between
+// the width, the frame rate and the colours or quality, and skipping those
+// already at their lowest. ratio is the target size over the last size. It
+// returns false when nothing can be lowered any more.
+func (s *AnimationStep) shrink(gif bool, ratio float64) bool {
+	for i := range 3 {
+		switch (s.Attempt - 1 + i) % 3 {
+		case 0:
+			if s.Width > minAnimationWidth {
+				factor := math.Min(math.Max(math.Sqrt(ratio), 0.5), 0.9)
+				s.Width = max(minAnimationWidth, evenRound(float64(s.Width)*factor))
+				return true
+			}
+		case 1:
+			if next := slices.IndexFunc(animationFPS, func(f float64) bool { return f < s.FPS }); next >= 0 {
+				s.FPS = animationFPS[next]
+				return true
+			}
+		case 2:
+			if gif {
+				if next := slices.IndexFunc(gifColors, func(c int) bool { return c < s.Colors }); next >= 0 {
+					s.Colors = gifColors[next]
+					return true
+				}
+			} else if next := slices.IndexFunc(webpQualities, func(q int) bool { return q < s.Quality }); next >= 0 {
+				s.Quality = webpQualities[next]
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inputArgs are the arguments that open the selected range of the input.
+func inputArgs(opts Options, plan Plan) []string {
+	if plan.Trimmed {
+		return []string{"-ss", formatSeconds(plan.Start), "-t", formatSeconds(plan.Duration), "-i", opts.Input}
+	}
+	return []string{"-i", opts.Input}
+}
+
+// encodeGIF generates a palette for the clip and then encodes it with that
+// palette, as ffmpeg's GIF encoder only has a generic one otherwise.
+func encodeGIF(ctx context.Context, opts Options, plan Plan, filter string, colors int, workDir, output string) error {
+	palette := filepath.Join(workDir, "palette.png")
+	args := []string{"-y", "-nostats", "-progress", "pipe:1"}
+	args = append(args, inputArgs(opts, plan)...)
+	args = append(args, "-vf", fmt.Sprintf("%s,palettegen=max_colors=%d:stats_mode=diff", filter, colors), "-update", "1", palette)
+	if err := runFFmpeg(ctx, opts, args, workDir, Progress{Pass: 1, Passes: 2, Duration: plan.Duration}); err != nil {
+		return fmt.Errorf("generating palette: %w", err)
+	}
+
+	args = []string{"-y", "-nostats", "-progress", "pipe:1"}
+	args = append(args, inputArgs(opts, plan)...)
+	args = append(args,
+		"-i", palette,
+		"-lavfi", "[0:v]"+filter+"[x];[x][1:v]paletteuse=dither=bayer:bayer_scale=5:diff_mode=rectangle",
+		"-an",
+		"-loop", "0",
+		output,
+	)
+	return runFFmpeg(ctx, opts, args, workDir, Progress{Pass: 2, Passes: 2, Duration: plan.Duration})
+}
+
+func encodeWebP(ctx context.Context, opts Options, plan Plan, filter, encoder string, quality int, output string) error {
+	args := []string{"-y", "-nostats", "-progress", "pipe:1"}
+	args = append(args, inputArgs(opts, plan)...)
+	args = append(args,
+		"-vf", filter,
+		"-an",
+		"-c:v", encoder,
+		"-lossless", "0",
+		"-q:v", strconv.Itoa(quality),
+		"-compression_level", "6",
+		"-loop", "0",
+		output,
+	)
+	return runFFmpeg(ctx, opts, args, "", Progress{Pass: 1, Passes: 1, Duration: plan.Duration})
+}
+
+// animatedWebPEncoder picks the ffmpeg encoder for animated WebP.
+func animatedWebPEncoder(ctx context.Context, opts Options) (string, error) {
+	encoders, err := Encoders(ctx, opts.runner())
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []string{"libwebp_anim", "libwebp"} {
+		if encoders[name] {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%w: libwebp (see ffmpeg -encoders)", ErrEncoderUnavailable)
+}
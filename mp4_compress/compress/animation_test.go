@@ -0,0 +1,89 @@
+package compress
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"phergul/mp4_compress/compress/compresstest"
+)
+
+func TestAnimate(t *testing.T) {
+	// At the starting width of 480 the output is 3000 KB; any narrower it
+	// is OutputKB.
+	tooLarge := []compresstest.SizeRule{{Arg: "scale=480:", KB: 3000}}
+	tests := []struct {
+		name     string
+		output   string
+		script   compresstest.Script
+		attempts int
+		last     AnimationStep
+		over     bool
+	}{
+		{
+			name:     "gif shrinks until under the target",
+			output:   "output.gif",
+			script:   compresstest.Script{OutputKB: 500, OutputIf: tooLarge},
+			attempts: 2,
+			last:     AnimationStep{Attempt: 2, Width: 280, FPS: 15, Colors: 256, Size: 500 << 10},
+		},
+		{
+			name:     "webp shrinks until under the target",
+			output:   "output.webp",
+			script:   compresstest.Script{OutputKB: 500, OutputIf: tooLarge, Encoders: []string{"libwebp_anim"}},
+			attempts: 2,
+			last:     AnimationStep{Attempt: 2, Width: 280, FPS: 15, Quality: 75, Size: 500 << 10},
+		},
+		{
+			name:     "first attempt fits",
+			output:   "output.gif",
+			script:   compresstest.Script{OutputKB: 500},
+			attempts: 1,
+			last:     AnimationStep{Attempt: 1, Width: 480, FPS: 15, Colors: 256, Size: 500 << 10},
+		},
+		{
+			name:     "gives up after the last attempt",
+			output:   "output.gif",
+			script:   compresstest.Script{OutputKB: 3000},
+			attempts: maxAnimationAttempts,
+			last:     AnimationStep{Attempt: maxAnimationAttempts, Width: 120, FPS: 8, Colors: 32, Size: 3000 << 10},
+			over:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.script.Duration, tt.script.Size = "20.5", 5<<20
+			runner, input := compresstest.New(t, tt.script)
+			opts := Options{
+				Input:    input,
+				Output:   filepath.Join(filepath.Dir(input), tt.output),
+				TargetMB: 1,
+				Runner:   runner,
+				TempDir:  t.TempDir(),
+			}
+			var steps []AnimationStep
+			opts.OnEvent = func(e Event) {
+				if e.Kind == EventAnimation {
+					steps = append(steps, *e.Animation)
+				}
+			}
+
+			res, err := Compress(context.Background(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Attempts != tt.attempts || res.OverTarget != tt.over || len(steps) != tt.attempts {
+				t.Fatalf("Result = %d attempts, over %v, %d events; want %d, %v", res.Attempts, res.OverTarget, len(steps), tt.attempts, tt.over)
+			}
+			if *res.Animation != tt.last {
+				t.Errorf("last attempt = %+v, want %+v", *res.Animation, tt.last)
+			}
+			for i := 1; i < len(steps); i++ {
+				prev, step := steps[i-1], steps[i]
+				if step.Width > prev.Width || step.FPS > prev.FPS || step.Colors > prev.Colors || step.Quality > prev.Quality {
+					t.Errorf("attempt %d raised a setting: %+v after %+v", step.Attempt, step, prev)
+				}
+			}
+		})
+	}
+}
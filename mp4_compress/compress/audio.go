@@ -0,0 +1,135 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// AudioMode selects what happens to the audio of the input.
+type AudioMode string
+
+const (
+	// AudioAuto keeps the audio track picked by Options.AudioTrack.
+	AudioAuto AudioMode = ""
+	// AudioKeep keeps every audio track.
+	AudioKeep AudioMode = "keep"
+	// AudioStereo keeps the selected track, downmixed to at most two
+	// channels.
+	AudioStereo AudioMode = "stereo"
+	// AudioNone strips the audio.
+	AudioNone AudioMode = "none"
+)
+
+const (
+	// perChannelAudioBitrate caps the planned bitrate, in kbps, for each
+	// channel, so mono sources get half of DefaultAudioBitrate.
+	perChannelAudioBitrate = 64.0
+	// minAudioBitrate is the lowest bitrate, in kbps, an audio track is
+	// scaled down to for small targets.
+	minAudioBitrate = 32.0
+	// maxAudioShare is the largest share of the total bitrate audio may take
+	// before it is scaled down.
+	maxAudioShare = 0.25
+)
+
+// ErrInvalidAudio is wrapped by errors about the audio options.
+var ErrInvalidAudio = errors.New("invalid audio options")
+
+// AudioTrackPlan is the encoding planned for one audio track of the output.
+type AudioTrackPlan struct {
+	Track    int     // position among the input's audio streams, as in -map 0:a:N
+	Kbps     float64 // bitrate of the encoded track
+	Channels int     // channels to downmix to, 0 to keep the source layout
+}
+
+// ParseAudioMode parses the -audio flag values "auto", "keep", "stereo" and
+// "none".
+func ParseAudioMode(s string) (AudioMode, error) {
+	switch s {
+	case "", "auto":
+		return AudioAuto, nil
+	case string(AudioKeep), string(AudioStereo), string(AudioNone):
+		return AudioMode(s), nil
+	}
+	return "", fmt.Errorf("%w: unknown audio mode %q", ErrInvalidAudio, s)
+}
+
+// planAudio picks the audio tracks to keep and their bitrates for a total
+// bitrate of totalKbps. It never plans more than the source bitrate of a
+// track, and scales the tracks down, to no less than minAudioBitrate, when
+// they would take more than maxAudioShare of the total. scaled reports that
+// the audio was reduced to leave room for the video.
+func planAudio(opts Options, info *MediaInfo, totalKbps float64) (tracks []AudioTrackPlan, scaled bool, err error) {
+	if opts.AudioMode == AudioNone || !info.HasAudio() {
+		return nil, false, nil
+	}
+
+	var selected []int
+	switch opts.AudioMode {
+	case AudioKeep:
+		for i := range info.Audio {
+			selected = append(selected, i)
+		}
+	case AudioAuto, AudioStereo:
+		if opts.AudioTrack < 0 || opts.AudioTrack >= len(info.Audio) {
+			return nil, false, fmt.Errorf("%w: audio track %d does not exist, the input has %d", ErrInvalidAudio, opts.AudioTrack, len(info.Audio))
+		}
+		selected = []int{opts.AudioTrack}
+	default:
+		return nil, false, fmt.Errorf("%w: unknown audio mode %q", ErrInvalidAudio, opts.AudioMode)
+	}
+
+	wanted := 0.0
+	for _, i := range selected {
+		stream := info.Audio[i]
+		track := AudioTrackPlan{Track: i, Kbps: DefaultAudioBitrate}
+
+		channels := stream.Channels
+		if opts.AudioMode == AudioStereo && channels > 2 {
+			channels = 2
+			track.Channels = 2
+		}
+		if channels > 0 {
+			track.Kbps = math.Min(track.Kbps, perChannelAudioBitrate*float64(channels))
+		}
+		if stream.Bitrate > 0 {
+			track.Kbps = math.Min(track.Kbps, stream.Bitrate)
+		}
+
+		wanted += track.Kbps
+		tracks = append(tracks, track)
+	}
+
+	if limit := totalKbps * maxAudioShare; wanted > limit {
+		for i := range tracks {
+			reduced := math.Max(tracks[i].Kbps*limit/wanted, minAudioBitrate)
+			if reduced < tracks[i].Kbps {
+				tracks[i].Kbps = math.Round(reduced)
+				scaled = true
+			}
+		}
+	}
+	return tracks, scaled, nil
+}
+
+// audioArgs builds the pass 2 ffmpeg arguments that map and encode tracks
+// with the given audio encoder.
+func audioArgs(tracks []AudioTrackPlan, encoder string) []string {
+	if len(tracks) == 0 {
+		return []string{"-an"}
+	}
+
+	var args []string
+	for _, track := range tracks {
+		args = append(args, "-map", fmt.Sprintf("0:a:%d", track.Track))
+	}
+	args = append(args, "-c:a", encoder)
+	for i, track := range tracks {
+		args = append(args, fmt.Sprintf("-b:a:%d", i), fmt.Sprintf("%.0fk", track.Kbps))
+		if track.Channels > 0 {
+			args = append(args, fmt.Sprintf("-ac:a:%d", i), fmt.Sprint(track.Channels))
+		}
+	}
+	return args
+}
@@ -0,0 +1,106 @@
+package compress
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestPlanAudio(t *testing.T) {
+	stereo := AudioStream{Codec: "aac", Channels: 2, Bitrate: 192}
+	info := func(streams ...AudioStream) *MediaInfo { return &MediaInfo{Duration: 60, Audio: streams} }
+	unlimited := math.Inf(1)
+	tests := []struct {
+		name   string
+		opts   Options
+		info   *MediaInfo
+		total  float64
+		tracks []AudioTrackPlan
+		scaled bool
+		err    error
+	}{
+		{name: "no audio", info: info(), total: unlimited},
+		{name: "audio none", opts: Options{AudioMode: AudioNone}, info: info(stereo), total: unlimited},
+		{name: "default bitrate", info: info(stereo), total: unlimited, tracks: []AudioTrackPlan{{Track: 0, Kbps: 128}}},
+		{
+			name:   "never above the source bitrate",
+			info:   info(AudioStream{Channels: 2, Bitrate: 96}),
+			total:  unlimited,
+			tracks: []AudioTrackPlan{{Track: 0, Kbps: 96}},
+		},
+		{name: "mono gets less", info: info(AudioStream{Channels: 1}), total: unlimited, tracks: []AudioTrackPlan{{Track: 0, Kbps: 64}}},
+		{name: "surround keeps its layout", info: info(AudioStream{Channels: 6}), total: unlimited, tracks: []AudioTrackPlan{{Track: 0, Kbps: 128}}},
+		{
+			name:   "stereo downmixes surround",
+			opts:   Options{AudioMode: AudioStereo},
+			info:   info(AudioStream{Channels: 6, Bitrate: 384}),
+			total:  unlimited,
+			tracks: []AudioTrackPlan{{Track: 0, Kbps: 128, Channels: 2}},
+		},
+		{
+			name:   "stereo leaves stereo alone",
+			opts:   Options{AudioMode: AudioStereo},
+			info:   info(stereo),
+			total:  unlimited,
+			tracks: []AudioTrackPlan{{Track: 0, Kbps: 128}},
+		},
+		{
+			name:   "stereo downmix is still capped by the source",
+			opts:   Options{AudioMode: AudioStereo},
+			info:   info(AudioStream{Channels: 6, Bitrate: 80}),
+			total:  unlimited,
+			tracks: []AudioTrackPlan{{Track: 0, Kbps: 80, Channels: 2}},
+		},
+		{
+			name:   "selected track",
+			opts:   Options{AudioTrack: 1},
+			info:   info(stereo, AudioStream{Channels: 1, Bitrate: 48}),
+			total:  unlimited,
+			tracks: []AudioTrackPlan{{Track: 1, Kbps: 48}},
+		},
+		{name: "selected track missing", opts: Options{AudioTrack: 1}, info: info(stereo), total: unlimited, err: ErrInvalidAudio},
+		{name: "negative track", opts: Options{AudioTrack: -1}, info: info(stereo), total: unlimited, err: ErrInvalidAudio},
+		{
+			name:   "keep takes every track",
+			opts:   Options{AudioMode: AudioKeep, AudioTrack: 5},
+			info:   info(stereo, AudioStream{Channels: 1, Bitrate: 48}),
+			total:  unlimited,
+			tracks: []AudioTrackPlan{{Track: 0, Kbps: 128}, {Track: 1, Kbps: 48}},
+		},
+		{
+			name:   "scaled to a quarter of the total",
+			info:   info(stereo),
+			total:  400,
+			tracks: []AudioTrackPlan{{Track: 0, Kbps: 100}},
+			scaled: true,
+		},
+		{
+			name:   "scaled no lower than the minimum",
+			info:   info(stereo),
+			total:  100,
+			tracks: []AudioTrackPlan{{Track: 0, Kbps: 32}},
+			scaled: true,
+		},
+		{
+			name:   "tracks share the scaling",
+			opts:   Options{AudioMode: AudioKeep},
+			info:   info(stereo, AudioStream{Channels: 2, Bitrate: 64}),
+			total:  576,
+			tracks: []AudioTrackPlan{{Track: 0, Kbps: 96}, {Track: 1, Kbps: 48}},
+			scaled: true,
+		},
+		{name: "unknown mode", opts: Options{AudioMode: "loud"}, info: info(stereo), total: unlimited, err: ErrInvalidAudio},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracks, scaled, err := planAudio(tt.opts, tt.info, tt.total)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("planAudio() error = %v, want %v", err, tt.err)
+			}
+			if !slices.Equal(tracks, tt.tracks) || scaled != tt.scaled {
+				t.Errorf("planAudio() = %+v, scaled %v; want %+v, %v", tracks, scaled, tt.tracks, tt.scaled)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package compress
+
+import (
+	"context"
+	"sync"
+)
+
+// JobResult is the outcome of one job of CompressAll. Exactly one of Result
+// and Err is set.
+type JobResult struct {
+	Options Options
+	Result  *Result
+	Err     error
+}
+
+// CompressAll runs Compress for every entry of jobs with at most workers
+// running at once and returns the results in the same order as jobs. Jobs
+// that have not started when ctx is cancelled fail with ctx's error. If
+// onDone is set it is called with the index and result of every job as it
+// finishes, from the goroutine that ran it.
+func CompressAll(ctx context.Context, jobs []Options, workers int, onDone func(int, JobResult)) []JobResult {
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]JobResult, len(jobs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, len(jobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = JobResult{Options: jobs[i]}
+				if err := ctx.Err(); err != nil {
+					results[i].Err = err
+				} else {
+					results[i].Result, results[i].Err = Compress(ctx, jobs[i])
+				}
+				if onDone != nil {
+					onDone(i, results[i])
+				}
+			}
+		}()
+	}
+
+	for i := range jobs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,54 @@
+package compress
+
+// MinTargetMB is the smallest target size, in MB, that a video of the given
+// duration can be planned at without its video bitrate being clamped to
+// MinVideoBitrate.
+func MinTargetMB(duration float64) float64 {
+	return (MinVideoBitrate + DefaultAudioBitrate) * duration / 8192 / overhead
+}
+
+// AllocateBudget splits totalMB across videos of the given durations in
+// proportion to their length. No video gets less than MinTargetMB of its
+// duration; the floors are taken out of the budget first and the rest is
+// shared between the others. ok is false if the floors alone exceed totalMB,
+// in which case every video gets its floor.
+func AllocateBudget(totalMB float64, durations []float64) (targets []float64, ok bool) {
+	targets = make([]float64, len(durations))
+	floored := make([]bool, len(durations))
+
+	for {
+		remaining, shared := totalMB, 0.0
+		for i, d := range durations {
+			if floored[i] {
+				remaining -= MinTargetMB(d)
+			} else {
+				shared += d
+			}
+		}
+		if remaining <= 0 || shared <= 0 {
+			break
+		}
+
+		changed := false
+		for i, d := range durations {
+			if floored[i] {
+				continue
+			}
+			targets[i] = remaining * d / shared
+			if targets[i] < MinTargetMB(d) {
+				floored[i] = true
+				changed = true
+			}
+		}
+		if !changed {
+			return targets, true
+		}
+	}
+
+	total := 0.0
+	for i, d := range durations {
+		targets[i] = MinTargetMB(d)
+		total += targets[i]
+	}
+	return targets, total <= totalMB
+}
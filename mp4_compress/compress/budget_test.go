@@ -0,0 +1,45 @@
+package compress
+
+import "testing"
+
+func TestAllocateBudget(t *testing.T) {
+	tests := []struct {
+		name      string
+		totalMB   float64
+		durations []float64
+		want      []float64
+		ok        bool
+	}{
+		{name: "in proportion to duration", totalMB: 100, durations: []float64{60, 180, 60}, want: []float64{20, 60, 20}, ok: true},
+		{name: "single video gets everything", totalMB: 8, durations: []float64{30}, want: []float64{8}, ok: true},
+		{name: "too small for the floors", totalMB: 1, durations: []float64{600, 600}, want: []float64{MinTargetMB(600), MinTargetMB(600)}},
+		{name: "nothing to share", totalMB: 10, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := AllocateBudget(tt.totalMB, tt.durations)
+			if ok != tt.ok || len(got) != len(tt.want) {
+				t.Fatalf("AllocateBudget() = %v, %v; want %v, %v", got, ok, tt.want, tt.ok)
+			}
+			for i := range got {
+				if !near(got[i], tt.want[i]) {
+					t.Errorf("AllocateBudget() = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestMinTargetMB(t *testing.T) {
+	// MinVideoBitrate plus DefaultAudioBitrate for 60 seconds, before the
+	// container overhead.
+	want := (100.0 + 128) * 60 / 8192 / overhead
+	if got := MinTargetMB(60); !near(got, want) {
+		t.Errorf("MinTargetMB(60) = %v, want %v", got, want)
+	}
+	if got := MinTargetMB(0); got != 0 {
+		t.Errorf("MinTargetMB(0) = %v, want 0", got)
+	}
+}
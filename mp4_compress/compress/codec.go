@@ -0,0 +1,271 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Codec is the ffmpeg name of a video encoder Compress can drive.
+type Codec string
+
+const (
+	CodecX264   Codec = "libx264"
+	CodecX265   Codec = "libx265"
+	CodecVP9    Codec = "libvpx-vp9"
+	CodecAOMAV1 Codec = "libaom-av1"
+	CodecSVTAV1 Codec = "libsvtav1"
+)
+
+// Codecs lists the supported encoders, default first.
+var Codecs = []Codec{CodecX264, CodecX265, CodecVP9, CodecAOMAV1, CodecSVTAV1}
+
+var (
+	// ErrUnknownCodec is returned for an Options.Codec not in Codecs.
+	ErrUnknownCodec = errors.New("unknown codec")
+	// ErrEncoderUnavailable is returned when the local ffmpeg was built
+	// without the requested encoder.
+	ErrEncoderUnavailable = errors.New("encoder not available in this ffmpeg build")
+	// ErrInvalidCodecOptions is wrapped by errors about -preset, -tune and
+	// -speed values that do not apply to the chosen codec.
+	ErrInvalidCodecOptions = errors.New("invalid codec options")
+)
+
+// codecInfo holds what differs between encoders.
+type codecInfo struct {
+	ext string // output extension used when naming outputs
+	// efficiency scales minBitsPerPixel: newer codecs look acceptable with
+	// fewer bits.
+	efficiency float64
+	// presets and tunes report whether -preset and -tune apply.
+	presets, tunes bool
+	// speed is the encoder's speed option, "" if it has none.
+	speed string
+	// maxCRF is the highest -crf the encoder accepts.
+	maxCRF float64
+	// onePass marks encoders ffmpeg cannot run in two passes: its libsvtav1
+	// wrapper ignores -pass, so target sizes are encoded in a single pass.
+	onePass bool
+}
+
+var codecs = map[Codec]codecInfo{
+	CodecX264:   {ext: ".mp4", efficiency: 1, presets: true, tunes: true, maxCRF: 51},
+	CodecX265:   {ext: ".mp4", efficiency: 0.7, presets: true, tunes: true, maxCRF: 51},
+	CodecVP9:    {ext: ".webm", efficiency: 0.7, speed: "-cpu-used", maxCRF: 63},
+	CodecAOMAV1: {ext: ".mp4", efficiency: 0.5, speed: "-cpu-used", maxCRF: 63},
+	CodecSVTAV1: {ext: ".mp4", efficiency: 0.5, presets: true, maxCRF: 63, onePass: true},
+}
+
+// ParseCodec parses a codec name. The short names x264, x265, vp9, av1 (for
+// libaom-av1) and svtav1 are accepted as well as the ffmpeg encoder names.
+func ParseCodec(s string) (Codec, error) {
+	switch strings.ToLower(s) {
+	case "", "x264", "h264":
+		return CodecX264, nil
+	case "x265", "h265", "hevc":
+		return CodecX265, nil
+	case "vp9":
+		return CodecVP9, nil
+	case "av1", "aom":
+		return CodecAOMAV1, nil
+	case "svtav1", "svt-av1":
+		return CodecSVTAV1, nil
+	}
+	if _, ok := codecs[Codec(s)]; ok {
+		return Codec(s), nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownCodec, s)
+}
+
+// Ext is the file extension outputs of c are given, with the dot.
+func (c Codec) Ext() string {
+	if info, ok := codecs[c.orDefault()]; ok {
+		return info.ext
+	}
+	return ".mp4"
+}
+
+func (c Codec) orDefault() Codec {
+	if c == "" {
+		return CodecX264
+	}
+	return c
+}
+
+// checkCodecOptions rejects presets, tunes and speeds the codec has no use
+// for, rather than silently ignoring them.
+func checkCodecOptions(opts Options, codec Codec) error {
+	info, ok := codecs[codec]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownCodec, codec)
+	}
+	if opts.Preset != "" && !info.presets {
+		return fmt.Errorf("%w: %s has no presets, use the speed setting instead", ErrInvalidCodecOptions, codec)
+	}
+	if opts.Tune != "" && !info.tunes {
+		return fmt.Errorf("%w: %s has no tunings", ErrInvalidCodecOptions, codec)
+	}
+	if opts.Speed != nil && info.speed == "" && codec != CodecSVTAV1 {
+		return fmt.Errorf("%w: %s has no speed setting, use a preset instead", ErrInvalidCodecOptions, codec)
+	}
+	return nil
+}
+
+// checkCRF rejects CRF values outside the range the codec accepts.
+func checkCRF(codec Codec, crf float64) error {
+	info, ok := codecs[codec]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownCodec, codec)
+	}
+	if crf <= 0 || crf > info.maxCRF || math.IsNaN(crf) {
+		return fmt.Errorf("%w: CRF for %s must be above 0 and at most %g", ErrInvalidCodecOptions, codec, info.maxCRF)
+	}
+	return nil
+}
+
+// crfArgs returns the rate control arguments for a constant-quality encode.
+// libvpx and libaom only treat -crf as constant quality when the bitrate is
+// unconstrained.
+func crfArgs(codec Codec, crf float64) []string {
+	args := []string{"-crf", strconv.FormatFloat(crf, 'f', -1, 64)}
+	if codec == CodecVP9 || codec == CodecAOMAV1 {
+		args = append(args, "-b:v", "0")
+	}
+	return args
+}
+
+// videoCodecArgs returns the encoder arguments for one pass, or for a single
+// pass encode when pass is 0. passLog is a file name prefix relative to the
+// directory ffmpeg runs in.
+func videoCodecArgs(opts Options, codec Codec, pass int, passLog string) []string {
+	args := []string{"-c:v", string(codec)}
+	if opts.Preset != "" {
+		args = append(args, "-preset", opts.Preset)
+	}
+	if opts.Tune != "" {
+		args = append(args, "-tune", opts.Tune)
+	}
+
+	switch codec {
+	case CodecX265:
+		args = append(args, "-tag:v", "hvc1")
+		if pass == 0 {
+			return args
+		}
+		// libx265 ignores -pass; its stats file is set through x265-params,
+		// whose ':' separator is why passLog must be a plain relative name.
+		return append(args, "-x265-params", fmt.Sprintf("pass=%d:stats=%s.log", pass, passLog))
+	case CodecVP9:
+		speed := 4
+		if pass != 1 {
+			speed = 2
+		}
+		if opts.Speed != nil {
+			speed = *opts.Speed
+		}
+		args = append(args, "-deadline", "good", "-cpu-used", strconv.Itoa(speed), "-row-mt", "1")
+	case CodecAOMAV1:
+		speed := 4
+		if opts.Speed != nil {
+			speed = *opts.Speed
+		}
+		args = append(args, "-cpu-used", strconv.Itoa(speed), "-row-mt", "1")
+	case CodecSVTAV1:
+		if opts.Preset == "" {
+			preset := 8
+			if opts.Speed != nil {
+				preset = *opts.Speed
+			}
+			args = append(args, "-preset", strconv.Itoa(preset))
+		}
+	}
+	if pass == 0 {
+		return args
+	}
+	return append(args, "-pass", strconv.Itoa(pass), "-passlogfile", passLog)
+}
+
+// audioCodec picks an audio encoder the output container accepts.
+func audioCodec(output string) string {
+	if strings.EqualFold(filepath.Ext(output), ".webm") {
+		return "libopus"
+	}
+	return "aac"
+}
+
+// Encoders lists the video and audio encoders the local ffmpeg was built
+// with, by parsing `ffmpeg -encoders`. A nil runner runs ffmpeg from the
+// PATH.
+func Encoders(ctx context.Context, runner Runner) (map[string]bool, error) {
+	cmd := orExec(runner).Command(ctx, "ffmpeg", "-hide_banner", "-encoders")
+	var out bytes.Buffer
+	stderr := newRingBuffer(stderrTail)
+	cmd.Stdout = &out
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, classifyFailure("ffmpeg", cmd.Path, err, stderr.Bytes())
+	}
+	return parseEncoders(out.Bytes()), nil
+}
+
+// parseEncoders reads the table `ffmpeg -encoders` prints after its legend:
+// lines of capability flags followed by the encoder name.
+func parseEncoders(data []byte) map[string]bool {
+	encoders := make(map[string]bool)
+	inTable := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !inTable {
+			inTable = strings.HasPrefix(line, "---")
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders
+}
+
+// ResolveCodec returns the codec Compress would encode opts with: opts.Codec,
+// or libx264 if the local ffmpeg lacks it and opts.CodecFallback is set.
+// Callers that name outputs with Codec.Ext should use the codec it returns,
+// as a fallback can change the container.
+func ResolveCodec(ctx context.Context, opts Options) (Codec, error) {
+	codec, _, err := resolveCodec(ctx, opts)
+	return codec, err
+}
+
+// resolveCodec checks that the encoder for opts.Codec is built into ffmpeg.
+// With opts.CodecFallback a missing encoder is replaced by libx264 and
+// fellBack is set.
+func resolveCodec(ctx context.Context, opts Options) (codec Codec, fellBack bool, err error) {
+	codec = opts.Codec.orDefault()
+	if _, ok := codecs[codec]; !ok {
+		return "", false, fmt.Errorf("%w %q", ErrUnknownCodec, codec)
+	}
+	if codec == CodecX264 {
+		return codec, false, nil
+	}
+
+	encoders, err := Encoders(ctx, opts.runner())
+	if err != nil {
+		return "", false, err
+	}
+	if encoders[string(codec)] {
+		return codec, false, nil
+	}
+	if opts.CodecFallback {
+		return CodecX264, true, nil
+	}
+	return "", false, fmt.Errorf("%w: %s (see ffmpeg -encoders)", ErrEncoderUnavailable, codec)
+}
@@ -0,0 +1,104 @@
+package compress
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseEncoders(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{
+			name: "legend then table",
+			out: `Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC (codec h264)
+ V....D libsvtav1            SVT-AV1(Scalable Video Technology for AV1) encoder (codec av1)
+
+ A....D aac                  AAC (Advanced Audio Coding)
+`,
+			want: []string{"aac", "libsvtav1", "libx264"},
+		},
+		{
+			name: "legend names are not encoders",
+			out:  "Encoders:\n V..... = Video\n",
+		},
+		{
+			name: "empty output",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := slices.Sorted(maps.Keys(parseEncoders([]byte(tt.out))))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseEncoders() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVideoCodecArgs(t *testing.T) {
+	speed := 10
+	tests := []struct {
+		codec Codec
+		opts  Options
+		pass  int
+		want  string
+	}{
+		{CodecX264, Options{}, 0, "-c:v libx264"},
+		{CodecX264, Options{Preset: "slow", Tune: "film"}, 1, "-c:v libx264 -preset slow -tune film -pass 1 -passlogfile log"},
+		{CodecX265, Options{}, 0, "-c:v libx265 -tag:v hvc1"},
+		{CodecX265, Options{}, 2, "-c:v libx265 -tag:v hvc1 -x265-params pass=2:stats=log.log"},
+		{CodecVP9, Options{}, 1, "-c:v libvpx-vp9 -deadline good -cpu-used 4 -row-mt 1 -pass 1 -passlogfile log"},
+		{CodecVP9, Options{}, 2, "-c:v libvpx-vp9 -deadline good -cpu-used 2 -row-mt 1 -pass 2 -passlogfile log"},
+		{CodecVP9, Options{Speed: &speed}, 2, "-c:v libvpx-vp9 -deadline good -cpu-used 10 -row-mt 1 -pass 2 -passlogfile log"},
+		{CodecAOMAV1, Options{}, 0, "-c:v libaom-av1 -cpu-used 4 -row-mt 1"},
+		{CodecSVTAV1, Options{}, 0, "-c:v libsvtav1 -preset 8"},
+		{CodecSVTAV1, Options{Speed: &speed}, 0, "-c:v libsvtav1 -preset 10"},
+		{CodecSVTAV1, Options{Preset: "6"}, 0, "-c:v libsvtav1 -preset 6"},
+	}
+	for _, tt := range tests {
+		got := strings.Join(videoCodecArgs(tt.opts, tt.codec, tt.pass, "log"), " ")
+		if got != tt.want {
+			t.Errorf("videoCodecArgs(%s, pass %d) = %q, want %q", tt.codec, tt.pass, got, tt.want)
+		}
+	}
+}
+
+func TestPassArgsOnePass(t *testing.T) {
+	// libsvtav1 gets a single pass at the planned bitrate; libx264 two.
+	tests := []struct {
+		codec Codec
+		want  []string
+	}{
+		{CodecX264, []string{
+			"-b:v 1196k -c:v libx264 -pass 1 -passlogfile ffmpeg2pass -an -f null",
+			"-b:v 1196k -c:v libx264 -pass 2 -passlogfile ffmpeg2pass -map 0:a:0",
+		}},
+		{CodecSVTAV1, []string{
+			"-b:v 1196k -c:v libsvtav1 -preset 8 -map 0:a:0",
+		}},
+	}
+	for _, tt := range tests {
+		opts := Options{Input: "in.mp4", TargetMB: 10, Codec: tt.codec}
+		plan, err := NewPlan(opts, stereoInput(60))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.Passes != len(tt.want) {
+			t.Fatalf("%s: plan has %d passes, want %d", tt.codec, plan.Passes, len(tt.want))
+		}
+		for i, want := range tt.want {
+			if got := strings.Join(passArgs(opts, plan, i+1, "out.mp4"), " "); !strings.Contains(got, want) {
+				t.Errorf("%s pass %d: %q does not contain %q", tt.codec, i+1, got, want)
+			}
+		}
+	}
+}
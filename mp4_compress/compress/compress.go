@@ -0,0 +1,721 @@
+// Package compress shrinks a video to a target file size with a two-pass
+// ffmpeg encode, or to a constant quality with a single CRF pass. It runs
+// ffmpeg and ffprobe through Options.Runner, which by default finds them on
+// the PATH.
+package compress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Passes is the number of ffmpeg passes Compress runs for a target
+	// size. Constant-quality jobs, and encoders without two-pass support,
+	// run one.
+	Passes = 2
+	// MinVideoBitrate is the lowest video bitrate, in kbps, Compress will
+	// plan regardless of the target size.
+	MinVideoBitrate = 100.0
+	// DefaultAudioBitrate is the audio bitrate, in kbps, reserved out of the
+	// target size.
+	DefaultAudioBitrate = 128.0
+	// killDelay is how long a cancelled ffmpeg gets to exit after being
+	// signalled before it is killed outright.
+	killDelay = 5 * time.Second
+	// overhead leaves room for the container so the output lands under the
+	// target rather than on it.
+	overhead = 0.97
+	// retryMargin is the extra share of the target bitrate taken off on each
+	// retry so a retry does not land just over the target again.
+	retryMargin = 0.01
+)
+
+// Options describes a single compression job. It can be stored as JSON,
+// without Info, Runner and OnEvent.
+type Options struct {
+	Input    string  `json:"input"`
+	Output   string  `json:"output"`
+	TargetMB float64 `json:"target_mb"`
+
+	// CRF, if non-zero, switches to constant-quality mode: a single pass at
+	// this CRF with no size target, so TargetMB must be zero. The valid
+	// range depends on the codec.
+	CRF float64 `json:"crf,omitempty"`
+
+	// MinSSIM, if non-zero, switches to a quality target: FindCRF picks the
+	// highest CRF whose samples reach this SSIM, and the input is encoded at
+	// it. TargetMB then becomes an optional upper bound, above which the job
+	// falls back to a two-pass encode at TargetMB.
+	MinSSIM float64 `json:"min_ssim,omitempty"`
+
+	// Info, if set, is used instead of probing Input again.
+	Info *MediaInfo `json:"-"`
+
+	// Start, End and Duration select the part of the input to keep, in
+	// seconds. Zero values mean the start and end of the input; End and
+	// Duration cannot both be set.
+	Start    float64 `json:"start,omitempty"`
+	End      float64 `json:"end,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+
+	// AudioMode and AudioTrack choose which audio streams to keep.
+	// AudioTrack counts audio streams only, from 0.
+	AudioMode  AudioMode `json:"audio_mode,omitempty"`
+	AudioTrack int       `json:"audio_track,omitempty"`
+
+	// Codec is the video encoder, libx264 when empty. Preset and Tune are
+	// passed to encoders that support them; Speed sets -cpu-used for VP9
+	// and libaom, or the numeric preset for SVT-AV1. If the local ffmpeg
+	// lacks the encoder Compress fails, or with CodecFallback uses libx264.
+	Codec         Codec  `json:"codec,omitempty"`
+	Preset        string `json:"preset,omitempty"`
+	Tune          string `json:"tune,omitempty"`
+	Speed         *int   `json:"speed,omitempty"`
+	CodecFallback bool   `json:"codec_fallback,omitempty"`
+
+	// MaxWidth, MaxHeight and MaxFPS cap the output video; zero means no
+	// limit. Unless NoAutoScale is set, the resolution and frame rate are
+	// also lowered automatically when the bitrate is too low for them.
+	MaxWidth    int     `json:"max_width,omitempty"`
+	MaxHeight   int     `json:"max_height,omitempty"`
+	MaxFPS      float64 `json:"max_fps,omitempty"`
+	NoAutoScale bool    `json:"no_auto_scale,omitempty"`
+
+	// MaxRetries, if positive, checks the size of the output after pass 2
+	// and re-runs pass 2 with a lower video bitrate, reusing the pass 1
+	// stats, up to this many times while the output exceeds TargetMB.
+	MaxRetries int `json:"max_retries,omitempty"`
+
+	// Force re-encodes inputs that already fit TargetMB. Otherwise such an
+	// input is copied, or remuxed when the output container differs or an
+	// MP4 needs its index moved to the front.
+	Force bool `json:"force,omitempty"`
+
+	// Measure compares the output with the input after encoding and stores
+	// the SSIM and PSNR in Result.Quality. A failed measurement is reported
+	// as a warning and does not fail the job.
+	Measure bool `json:"measure,omitempty"`
+
+	// TempDir is where each job creates its private directory for ffmpeg's
+	// pass logs. Empty means os.TempDir().
+	TempDir string `json:"temp_dir,omitempty"`
+
+	// WorkDir, if set, is used for the pass logs instead of a private
+	// directory in TempDir, and is left in place afterwards. A later run
+	// with the same WorkDir whose pass 1 would be identical skips straight
+	// to pass 2, so an interrupted job can be resumed.
+	WorkDir string `json:"work_dir,omitempty"`
+
+	// LogDir is where the stderr of a failed ffmpeg run is saved, as
+	// <output name>.ffmpeg.log. Empty means next to Output.
+	LogDir string `json:"log_dir,omitempty"`
+
+	// Runner starts ffmpeg and ffprobe. Nil runs them from the PATH.
+	Runner Runner `json:"-"`
+
+	// OnEvent, if set, is called synchronously for every Event of the run.
+	OnEvent func(Event) `json:"-"`
+}
+
+// Plan is the bitrate budget computed for a job.
+type Plan struct {
+	TargetMB  float64
+	Start     float64
+	End       float64
+	Duration  float64 // End - Start
+	Trimmed   bool    // whether Start/End differ from the whole input
+	VideoKbps float64
+	AudioKbps float64          // total of Audio
+	Audio     []AudioTrackPlan // empty when the output has no audio
+	Clamped   bool             // VideoKbps was raised to MinVideoBitrate
+
+	// CRF is set instead of TargetMB and VideoKbps for constant-quality
+	// jobs. Passes is the number of ffmpeg passes the plan needs.
+	CRF    float64
+	Passes int
+
+	// Codec is the video encoder the job uses.
+	Codec Codec
+
+	// Width, Height and FPS are the scaled output video, or zero where the
+	// source is kept.
+	Width  int
+	Height int
+	FPS    float64
+
+	// AudioScaled is set when the audio was planned below its usual bitrate
+	// because the target is small.
+	AudioScaled bool
+}
+
+// Result describes a finished compression.
+type Result struct {
+	Info   *MediaInfo
+	Plan   Plan // the plan of the final attempt
+	Output string
+	Size   int64
+	Action Action
+
+	// Attempts is how many times pass 2 ran. OverTarget is set when the
+	// output is still larger than the target after the last attempt.
+	Attempts   int
+	OverTarget bool
+
+	// Quality is set when Options.Measure was and the measurement worked.
+	Quality *Quality
+	// Search is the CRF FindCRF chose when Options.MinSSIM was set.
+	Search *SearchStep
+	// Animation is the last attempt of Animate for GIF and WebP outputs.
+	Animation *AnimationStep
+}
+
+// Bitrate is the effective overall bitrate of the output in kbps, comparable
+// with the bitrates planned for a target size.
+func (r *Result) Bitrate() float64 {
+	if r.Plan.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Size) * 8 / 1024 / r.Plan.Duration
+}
+
+// Ratio is the output size as a fraction of the input size, or 0 if the
+// input size is unknown.
+func (r *Result) Ratio() float64 {
+	if r.Info == nil || r.Info.Size == 0 {
+		return 0
+	}
+	return float64(r.Size) / float64(r.Info.Size)
+}
+
+// EventKind identifies what an Event reports.
+type EventKind string
+
+const (
+	EventProbe     EventKind = "probe"
+	EventPlan      EventKind = "plan"
+	EventPassStart EventKind = "pass_start"
+	EventProgress  EventKind = "progress"
+	EventPassEnd   EventKind = "pass_end"
+	EventPassSkip  EventKind = "pass_skip"
+	EventRetry     EventKind = "retry"
+	EventWarning   EventKind = "warning"
+	EventMeasure   EventKind = "measure"
+	EventSearch    EventKind = "search"
+	EventKeep      EventKind = "keep"
+	EventAnimation EventKind = "animation"
+)
+
+// Event is sent to Options.OnEvent as a job runs. Only the fields relevant to
+// Kind are set.
+type Event struct {
+	Kind      EventKind
+	Info      *MediaInfo     // EventProbe, EventKeep
+	Plan      *Plan          // EventPlan, EventRetry, EventKeep
+	Pass      int            // EventPassStart, EventPassEnd, EventPassSkip
+	Passes    int            // EventPassStart, EventPassEnd, EventPassSkip
+	Progress  Progress       // EventProgress
+	Attempt   int            // EventRetry: the attempt about to run, from 2
+	Size      int64          // EventRetry: size of the previous attempt
+	Message   string         // EventWarning
+	Step      *SearchStep    // EventSearch
+	Action    Action         // EventKeep
+	Animation *AnimationStep // EventAnimation
+}
+
+// Compress probes opts.Input and encodes it to opts.Output so that the
+// result fits in opts.TargetMB, at opts.CRF, or at the CRF FindCRF picks for
+// opts.MinSSIM. Inputs already within opts.TargetMB are copied or remuxed
+// instead unless opts.Force is set, and GIF and WebP outputs are made with
+// Animate. The output is written to a temporary file next to opts.Output
+// and renamed into place only once every pass succeeds. Cancelling ctx stops
+// the running ffmpeg and removes everything the job wrote, except the pass
+// logs in opts.WorkDir, whose pass 1 a later run reuses.
+func Compress(ctx context.Context, opts Options) (*Result, error) {
+	res, err := compressJob(ctx, opts)
+	return res, opts.logFailure(err)
+}
+
+func compressJob(ctx context.Context, opts Options) (*Result, error) {
+	if IsAnimation(opts.Output) {
+		return Animate(ctx, opts)
+	}
+	if opts.MinSSIM != 0 && opts.CRF != 0 {
+		return nil, fmt.Errorf("%w: a CRF and a minimum SSIM cannot be used together", ErrInvalidQuality)
+	}
+	if opts.CRF == 0 && opts.MinSSIM == 0 && (opts.TargetMB <= 0 || math.IsNaN(opts.TargetMB) || math.IsInf(opts.TargetMB, 0)) {
+		return nil, ErrInvalidTarget
+	}
+
+	info, err := opts.probe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !info.HasVideo() {
+		return nil, fmt.Errorf("%w in %s", ErrNoVideo, opts.Input)
+	}
+
+	if !opts.Force && fitsTarget(opts, info) {
+		res, err := keep(ctx, opts, info)
+		if err == nil || IsCanceled(err) {
+			return res, err
+		}
+		opts.emit(Event{Kind: EventWarning, Message: fmt.Sprintf("%v; encoding instead", err)})
+	}
+
+	if opts, err = opts.settleCodec(ctx); err != nil {
+		return nil, err
+	}
+
+	// With MinSSIM, TargetMB is only an upper bound: the search result is
+	// encoded at its CRF unless it is expected to, or does, exceed it.
+	var search *SearchStep
+	limitMB := 0.0
+	if opts.MinSSIM != 0 {
+		step, met, err := FindCRF(ctx, opts, info)
+		if err != nil {
+			return nil, err
+		}
+		search = &step
+		if !met {
+			opts.emit(Event{Kind: EventWarning, Message: fmt.Sprintf(
+				"SSIM %.4f is not reached at any CRF searched, using CRF %g (SSIM %.4f)", opts.MinSSIM, step.CRF, step.SSIM)})
+		}
+		if opts.TargetMB > 0 && step.EstimatedMB > opts.TargetMB {
+			opts.emit(Event{Kind: EventWarning, Message: fmt.Sprintf(
+				"CRF %g needs about %.2f MB, over the %.2f MB limit; encoding to the limit instead", step.CRF, step.EstimatedMB, opts.TargetMB)})
+		} else {
+			limitMB = opts.TargetMB
+			opts.CRF, opts.TargetMB = step.CRF, 0
+		}
+	}
+
+	plan, err := NewPlan(opts, info)
+	if err != nil {
+		return nil, err
+	}
+	opts.emitPlan(plan)
+
+	// ffmpeg runs inside workDir so that pass logs and any other files the
+	// encoders write stay there; the paths it gets must be absolute.
+	workDir, cleanup, err := opts.jobDir()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if opts.Input, err = absPath(opts.Input); err != nil {
+		return nil, err
+	}
+	output, err := absPath(opts.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	partial, err := partialFile(output)
+	if err != nil {
+		return nil, fmt.Errorf("creating output: %w", err)
+	}
+	defer os.Remove(partial)
+
+	res, err := encode(ctx, opts, plan, opts.firstPass(plan), workDir, partial)
+	if err != nil {
+		return nil, err
+	}
+	if limitMB > 0 && res.Size > int64(limitMB*1024*1024) {
+		opts.emit(Event{Kind: EventWarning, Message: fmt.Sprintf(
+			"CRF %g output is %.2f MB, over the %.2f MB limit; encoding to the limit instead", plan.CRF, float64(res.Size)/(1024*1024), limitMB)})
+		opts.CRF, opts.TargetMB = 0, limitMB
+		if plan, err = NewPlan(opts, info); err != nil {
+			return nil, err
+		}
+		opts.emitPlan(plan)
+		if res, err = encode(ctx, opts, plan, opts.firstPass(plan), workDir, partial); err != nil {
+			return nil, err
+		}
+	}
+	res.Info, res.Output, res.Action, res.Search = info, output, ActionEncode, search
+	if err := opts.finish(ctx, res, partial); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// probe returns opts.Info, or probes opts.Input if it is not set, and
+// reports it.
+func (opts Options) probe(ctx context.Context) (*MediaInfo, error) {
+	info := opts.Info
+	if info == nil {
+		var err error
+		if info, err = Probe(ctx, opts.runner(), opts.Input); err != nil {
+			return nil, err
+		}
+	}
+	opts.emit(Event{Kind: EventProbe, Info: info})
+	return info, nil
+}
+
+// settleCodec checks the encoder of opts against the local ffmpeg and
+// returns opts with libx264 in its place if it fell back.
+func (opts Options) settleCodec(ctx context.Context) (Options, error) {
+	codec, fellBack, err := resolveCodec(ctx, opts)
+	if err != nil {
+		return opts, err
+	}
+	if fellBack {
+		// An output named for the requested codec's container, such as
+		// .webm for VP9, cannot hold the fallback.
+		if ext := opts.Codec.Ext(); ext != codec.Ext() && strings.EqualFold(filepath.Ext(opts.Output), ext) {
+			return opts, fmt.Errorf("%w: %s, and %s cannot be written to a %s file (use a %s output)",
+				ErrEncoderUnavailable, opts.Codec, codec, ext, codec.Ext())
+		}
+		opts.emit(Event{Kind: EventWarning, Message: fmt.Sprintf(
+			"%s is not available in this ffmpeg build, using %s", opts.Codec, codec)})
+		opts.Codec, opts.Preset, opts.Tune, opts.Speed = codec, "", "", nil
+	}
+	return opts, nil
+}
+
+// finish measures the encoded partial file if opts.Measure is set and
+// renames it to res.Output.
+func (opts Options) finish(ctx context.Context, res *Result, partial string) error {
+	if opts.Measure {
+		opts.emit(Event{Kind: EventMeasure})
+		measured := *res
+		measured.Output = partial
+		q, err := Measure(ctx, opts.runner(), opts.Input, &measured)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			opts.emit(Event{Kind: EventWarning, Message: fmt.Sprintf("quality measurement failed: %v", err)})
+		default:
+			res.Quality = q
+		}
+	}
+
+	if err := os.Rename(partial, res.Output); err != nil {
+		return fmt.Errorf("moving output into place: %w", err)
+	}
+	return nil
+}
+
+// emitPlan reports plan and the compromises it makes.
+func (opts Options) emitPlan(plan Plan) {
+	opts.emit(Event{Kind: EventPlan, Plan: &plan})
+	if plan.AudioScaled {
+		opts.emit(Event{Kind: EventWarning, Message: fmt.Sprintf(
+			"audio reduced to %.0f kbps to leave room for video", plan.AudioKbps)})
+	}
+	if plan.Clamped {
+		opts.emit(Event{Kind: EventWarning, Message: fmt.Sprintf(
+			"target size is too small for %.1f sec, video bitrate clamped to %.0f kbps; output will exceed %.2f MB",
+			plan.Duration, MinVideoBitrate, plan.TargetMB)})
+	}
+}
+
+// encode runs the passes of plan from firstPass on into output, then checks
+// the size and retries pass 2 as opts.MaxRetries allows. The Result has
+// Plan, Size, Attempts and OverTarget set.
+func encode(ctx context.Context, opts Options, plan Plan, firstPass int, workDir, output string) (*Result, error) {
+	for pass := firstPass; pass <= plan.Passes; pass++ {
+		if pass == 1 {
+			opts.clearPass1()
+		}
+		if err := runPass(ctx, opts, plan, pass, workDir, output); err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, &PassError{Pass: pass, Err: err}
+		}
+		if pass == 1 {
+			if err := opts.markPass1(plan); err != nil {
+				opts.emit(Event{Kind: EventWarning, Message: fmt.Sprintf("cannot record pass 1 for resuming: %v", err)})
+			}
+		}
+	}
+
+	res := &Result{}
+	for res.Attempts = 1; ; res.Attempts++ {
+		stat, err := os.Stat(output)
+		if err != nil {
+			return nil, fmt.Errorf("reading output: %w", err)
+		}
+		res.Size = stat.Size()
+		res.OverTarget = plan.TargetMB > 0 && res.Size > plan.TargetBytes()
+		if !res.OverTarget || res.Attempts > opts.MaxRetries {
+			break
+		}
+
+		next, ok := retryPlan(plan, res.Size)
+		if !ok {
+			opts.emit(Event{Kind: EventWarning, Message: fmt.Sprintf(
+				"output is still over %.2f MB at the minimum video bitrate of %.0f kbps", plan.TargetMB, MinVideoBitrate)})
+			break
+		}
+		plan = next
+		opts.emit(Event{Kind: EventRetry, Plan: &plan, Attempt: res.Attempts + 1, Size: res.Size})
+
+		if err := runPass(ctx, opts, plan, plan.Passes, workDir, output); err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, &PassError{Pass: plan.Passes, Err: err}
+		}
+	}
+	res.Plan = plan
+	return res, nil
+}
+
+// TargetBytes is the target size in bytes.
+func (p Plan) TargetBytes() int64 {
+	return int64(p.TargetMB * 1024 * 1024)
+}
+
+// retryPlan lowers the video bitrate of plan by the bitrate the previous
+// attempt overshot the target by, plus a small margin. ok is false when the
+// bitrate is already at MinVideoBitrate and cannot go lower.
+func retryPlan(plan Plan, size int64) (next Plan, ok bool) {
+	if plan.VideoKbps <= MinVideoBitrate {
+		return plan, false
+	}
+
+	overshootKbps := float64(size-plan.TargetBytes()) * 8 / 1024 / plan.Duration
+	marginKbps := plan.TargetMB * 8192 / plan.Duration * retryMargin
+	plan.VideoKbps = math.Max(plan.VideoKbps-overshootKbps-marginKbps, MinVideoBitrate)
+	plan.Clamped = plan.VideoKbps == MinVideoBitrate
+	return plan, true
+}
+
+// absPath makes a local path absolute and leaves URLs alone.
+func absPath(path string) (string, error) {
+	if strings.Contains(path, "://") {
+		return path, nil
+	}
+	return filepath.Abs(path)
+}
+
+// partialFile creates an empty temporary file next to output to encode into.
+// It keeps output's extension so ffmpeg picks the same container, and is
+// created with the mode os.Create would give output, which ffmpeg and the
+// final rename keep.
+func partialFile(output string) (string, error) {
+	dir, name := filepath.Split(output)
+	ext := filepath.Ext(name)
+	prefix := filepath.Join(dir, "."+strings.TrimSuffix(name, ext)+".")
+	for range 10000 {
+		path := prefix + strconv.FormatUint(uint64(rand.Uint32()), 10) + ".partial" + ext
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return path, f.Close()
+	}
+	return "", fmt.Errorf("cannot create a partial file next to %s", output)
+}
+
+// NewPlan resolves the trim range of opts against the probed input and
+// computes the video and audio bitrates that fit opts.TargetMB. Audio is
+// planned from the probed streams, so inputs without audio give the whole
+// budget to video. With opts.CRF only the audio and the Max* limits are
+// planned.
+func NewPlan(opts Options, info *MediaInfo) (Plan, error) {
+	if opts.CRF != 0 && opts.TargetMB != 0 {
+		return Plan{}, fmt.Errorf("%w: a target size and a CRF cannot be used together", ErrInvalidTarget)
+	}
+	if opts.CRF == 0 && opts.TargetMB <= 0 {
+		return Plan{}, ErrInvalidTarget
+	}
+	if err := checkCodecOptions(opts, opts.Codec.orDefault()); err != nil {
+		return Plan{}, err
+	}
+	start, end, err := opts.Range(info.Duration)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	plan := Plan{
+		Codec:    opts.Codec.orDefault(),
+		TargetMB: opts.TargetMB,
+		Start:    start,
+		End:      end,
+		Duration: end - start,
+		Trimmed:  start > 0 || end < info.Duration,
+		Passes:   Passes,
+	}
+	if codecs[plan.Codec].onePass {
+		plan.Passes = 1
+	}
+
+	if opts.CRF != 0 {
+		if err := checkCRF(plan.Codec, opts.CRF); err != nil {
+			return Plan{}, err
+		}
+		plan.CRF, plan.Passes = opts.CRF, 1
+		// Without a size budget audio keeps its usual bitrate and the video
+		// is only scaled down to the Max* limits.
+		plan.Audio, _, err = planAudio(opts, info, math.Inf(1))
+		if err != nil {
+			return Plan{}, err
+		}
+		for _, track := range plan.Audio {
+			plan.AudioKbps += track.Kbps
+		}
+		if len(info.Video) > 0 {
+			opts.NoAutoScale = true
+			plan.Width, plan.Height, plan.FPS = planScale(opts, info.Video[0], 0, codecs[plan.Codec].efficiency)
+		}
+		return plan, nil
+	}
+
+	totalBitrate := (opts.TargetMB * 8192) / plan.Duration
+	//account for overhead
+	totalBitrate *= overhead
+
+	plan.Audio, plan.AudioScaled, err = planAudio(opts, info, totalBitrate)
+	if err != nil {
+		return Plan{}, err
+	}
+	for _, track := range plan.Audio {
+		plan.AudioKbps += track.Kbps
+	}
+	plan.VideoKbps = math.Max(totalBitrate-plan.AudioKbps, MinVideoBitrate)
+	plan.Clamped = totalBitrate-plan.AudioKbps < MinVideoBitrate
+
+	if len(info.Video) > 0 {
+		plan.Width, plan.Height, plan.FPS = planScale(opts, info.Video[0], plan.VideoKbps, codecs[plan.Codec].efficiency)
+	}
+	return plan, nil
+}
+
+// Range resolves Start, End and Duration against the duration of the input
+// and returns the part of it to encode, in seconds.
+func (opts Options) Range(inputDuration float64) (start, end float64, err error) {
+	if opts.End != 0 && opts.Duration != 0 {
+		return 0, 0, fmt.Errorf("%w: end and duration cannot be used together", ErrInvalidTrim)
+	}
+	if opts.Start < 0 || opts.End < 0 || opts.Duration < 0 {
+		return 0, 0, fmt.Errorf("%w: times cannot be negative", ErrInvalidTrim)
+	}
+	if inputDuration <= 0 {
+		return 0, 0, fmt.Errorf("%w: input has no duration", ErrInvalidTrim)
+	}
+
+	start, end = opts.Start, inputDuration
+	if opts.End != 0 {
+		end = opts.End
+	}
+	if opts.Duration != 0 {
+		end = start + opts.Duration
+	}
+
+	if start >= inputDuration {
+		return 0, 0, fmt.Errorf("%w: start %s is beyond the end of the video (%s)", ErrInvalidTrim, FormatClock(start), FormatClock(inputDuration))
+	}
+	if end > inputDuration {
+		return 0, 0, fmt.Errorf("%w: end %s is beyond the end of the video (%s)", ErrInvalidTrim, FormatClock(end), FormatClock(inputDuration))
+	}
+	if end <= start {
+		return 0, 0, fmt.Errorf("%w: end %s must be after start %s", ErrInvalidTrim, FormatClock(end), FormatClock(start))
+	}
+	return start, end, nil
+}
+
+// passLogName is the -passlogfile prefix, relative to the job's work
+// directory.
+const passLogName = "ffmpeg2pass"
+
+// passArgs builds the ffmpeg arguments for one pass of plan. output is the
+// file the last pass writes.
+func passArgs(opts Options, plan Plan, pass int, output string) []string {
+	args := []string{"-y", "-nostats", "-progress", "pipe:1"}
+	if plan.Trimmed {
+		args = append(args, "-ss", formatSeconds(plan.Start), "-i", opts.Input, "-t", formatSeconds(plan.Duration))
+	} else {
+		args = append(args, "-i", opts.Input)
+	}
+	args = append(args, "-map", "0:v:0")
+	if filter := videoFilter(plan); filter != "" {
+		args = append(args, "-vf", filter)
+	}
+	if plan.CRF != 0 {
+		args = append(args, videoCodecArgs(opts, plan.Codec, 0, "")...)
+		args = append(args, crfArgs(plan.Codec, plan.CRF)...)
+	} else {
+		args = append(args, "-b:v", fmt.Sprintf("%.0fk", plan.VideoKbps))
+		if plan.Passes == 1 {
+			pass = 0
+		}
+		args = append(args, videoCodecArgs(opts, plan.Codec, pass, passLogName)...)
+		if pass == 1 {
+			return append(args, "-an", "-f", "null", os.DevNull)
+		}
+	}
+	args = append(args, audioArgs(plan.Audio, audioCodec(output))...)
+	return append(args, output)
+}
+
+// runPass runs one ffmpeg pass in workDir and reports its -progress output.
+func runPass(ctx context.Context, opts Options, plan Plan, pass int, workDir, output string) error {
+	opts.emit(Event{Kind: EventPassStart, Pass: pass, Passes: plan.Passes})
+	progress := Progress{Pass: pass, Passes: plan.Passes, Duration: plan.Duration}
+	if err := runFFmpeg(ctx, opts, passArgs(opts, plan, pass, output), workDir, progress); err != nil {
+		return err
+	}
+	opts.emit(Event{Kind: EventPassEnd, Pass: pass, Passes: plan.Passes})
+	return nil
+}
+
+// runFFmpeg runs ffmpeg with args in dir, which may be empty, and reports
+// its -progress output as EventProgress on top of p. A failure is returned
+// as a *ToolError that keeps the end of ffmpeg's stderr for logFailure.
+func runFFmpeg(ctx context.Context, opts Options, args []string, dir string, p Progress) error {
+	cmd := opts.runner().Command(ctx, "ffmpeg", args...)
+	cmd.Dir = dir
+	setProcessGroup(cmd)
+	cmd.WaitDelay = killDelay
+	stderr := newRingBuffer(stderrTail)
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return classifyFailure("ffmpeg", cmd.Path, err, nil)
+	}
+
+	readProgress(stdout, p, func(p Progress) {
+		opts.emit(Event{Kind: EventProgress, Pass: p.Pass, Progress: p})
+	})
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		failure := classifyFailure("ffmpeg", cmd.Path, err, stderr.Bytes())
+		failure.args, failure.stderr = args, stderr
+		return failure
+	}
+	return nil
+}
+
+func (opts Options) emit(e Event) {
+	if opts.OnEvent != nil {
+		opts.OnEvent(e)
+	}
+}
+
+// IsCanceled reports whether err was caused by a cancelled or expired
+// context.
+func IsCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,534 @@
+package compress
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"phergul/mp4_compress/compress/compresstest"
+)
+
+func stereoInput(duration float64) *MediaInfo {
+	return &MediaInfo{
+		Duration: duration,
+		Audio:    []AudioStream{{Index: 1, Codec: "aac", Channels: 2, SampleRate: 48000, Bitrate: 128}},
+	}
+}
+
+func TestNewPlanBitrates(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      Options
+		info      *MediaInfo
+		duration  float64
+		videoKbps float64
+		audioKbps float64
+		clamped   bool
+		scaled    bool
+		err       error
+	}{
+		{
+			name:      "target split between video and audio",
+			opts:      Options{TargetMB: 10},
+			info:      stereoInput(60),
+			duration:  60,
+			videoKbps: 10*8192/60.0*overhead - 128,
+			audioKbps: 128,
+		},
+		{
+			name:      "no audio stream gives video everything",
+			opts:      Options{TargetMB: 10},
+			info:      &MediaInfo{Duration: 60},
+			duration:  60,
+			videoKbps: 10 * 8192 / 60.0 * overhead,
+		},
+		{
+			name:      "audio none gives video everything",
+			opts:      Options{TargetMB: 10, AudioMode: AudioNone},
+			info:      stereoInput(60),
+			duration:  60,
+			videoKbps: 10 * 8192 / 60.0 * overhead,
+		},
+		{
+			name:      "trim plans for the kept range only",
+			opts:      Options{TargetMB: 10, Start: 30},
+			info:      stereoInput(60),
+			duration:  30,
+			videoKbps: 10*8192/30.0*overhead - 128,
+			audioKbps: 128,
+		},
+		{
+			name:      "tiny target clamps video and lowers audio",
+			opts:      Options{TargetMB: 1},
+			info:      stereoInput(600),
+			duration:  600,
+			videoKbps: MinVideoBitrate,
+			audioKbps: minAudioBitrate,
+			clamped:   true,
+			scaled:    true,
+		},
+		{
+			// The 228 kbps MinTargetMB allows for leaves audio its 25%
+			// share, so video ends up above the minimum.
+			name:      "minimum target is not clamped",
+			opts:      Options{TargetMB: MinTargetMB(60)},
+			info:      stereoInput(60),
+			duration:  60,
+			videoKbps: 171,
+			audioKbps: 57,
+			scaled:    true,
+		},
+		{name: "zero target", opts: Options{TargetMB: 0}, info: stereoInput(60), err: ErrInvalidTarget},
+		{name: "negative target", opts: Options{TargetMB: -5}, info: stereoInput(60), err: ErrInvalidTarget},
+		{name: "start past the end", opts: Options{TargetMB: 10, Start: 70}, info: stereoInput(60), err: ErrInvalidTrim},
+		{name: "end before start", opts: Options{TargetMB: 10, Start: 30, End: 20}, info: stereoInput(60), err: ErrInvalidTrim},
+		{name: "missing audio track", opts: Options{TargetMB: 10, AudioTrack: 3}, info: stereoInput(60), err: ErrInvalidAudio},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := NewPlan(tt.opts, tt.info)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("NewPlan() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewPlan() error = %v", err)
+			}
+			if !near(plan.Duration, tt.duration) {
+				t.Errorf("Duration = %v, want %v", plan.Duration, tt.duration)
+			}
+			if !near(plan.VideoKbps, tt.videoKbps) {
+				t.Errorf("VideoKbps = %v, want %v", plan.VideoKbps, tt.videoKbps)
+			}
+			if !near(plan.AudioKbps, tt.audioKbps) {
+				t.Errorf("AudioKbps = %v, want %v", plan.AudioKbps, tt.audioKbps)
+			}
+			if plan.Clamped != tt.clamped {
+				t.Errorf("Clamped = %v, want %v", plan.Clamped, tt.clamped)
+			}
+			if plan.AudioScaled != tt.scaled {
+				t.Errorf("AudioScaled = %v, want %v", plan.AudioScaled, tt.scaled)
+			}
+		})
+	}
+}
+
+func TestRetryPlan(t *testing.T) {
+	plan := Plan{TargetMB: 10, Duration: 100, VideoKbps: 700}
+	tests := []struct {
+		name  string
+		plan  Plan
+		size  int64
+		video float64
+		ok    bool
+	}{
+		// 1 MB over 100 seconds is 81.92 kbps, plus a 1% margin of the
+		// 819.2 kbps target.
+		{name: "lowers by the overshoot", plan: plan, size: 11 << 20, video: 700 - 81.92 - 8.192, ok: true},
+		{name: "stops at the minimum", plan: plan, size: 20 << 20, video: MinVideoBitrate, ok: true},
+		{name: "already at the minimum", plan: Plan{TargetMB: 10, Duration: 100, VideoKbps: MinVideoBitrate}, size: 11 << 20, video: MinVideoBitrate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, ok := retryPlan(tt.plan, tt.size)
+			if ok != tt.ok || !near(next.VideoKbps, tt.video) {
+				t.Errorf("retryPlan() = %v kbps, %v; want %v kbps, %v", next.VideoKbps, ok, tt.video, tt.ok)
+			}
+		})
+	}
+}
+
+// moovFirstMP4 is the start of an MP4 file whose index comes before its
+// media data, so it can be copied as it is.
+var moovFirstMP4 = []byte("\x00\x00\x00\x08ftyp\x00\x00\x00\x08moov\x00\x00\x00\x08mdat")
+
+func TestCompress(t *testing.T) {
+	progress := []float64{5, 10, 20.5}
+	tests := []struct {
+		name     string
+		script   compresstest.Script
+		input    []byte // replaces the contents of the fake input
+		opts     Options
+		ctx      func() context.Context
+		err      error
+		errText  string
+		pass     int // the pass a *PassError is for
+		size     int64
+		attempts int
+		over     bool
+		commands []string // prefixes of the logged commands, in order; nil skips the check
+		warning  string
+	}{
+		{
+			name:     "two passes",
+			script:   compresstest.Script{Duration: "20.5", Size: 5 << 20, Progress: progress, OutputKB: 1024},
+			opts:     Options{TargetMB: 2},
+			size:     1 << 20,
+			attempts: 1,
+			commands: []string{"ffprobe", "ffmpeg -y", "ffmpeg -y"},
+		},
+		{
+			name:     "svtav1 encodes in one pass",
+			script:   compresstest.Script{Duration: "20.5", Size: 5 << 20, Progress: progress, OutputKB: 1024, Encoders: []string{"libsvtav1"}},
+			opts:     Options{TargetMB: 2, Codec: CodecSVTAV1},
+			size:     1 << 20,
+			attempts: 1,
+			commands: []string{"ffprobe", "ffmpeg -hide_banner -encoders", "ffmpeg -y"},
+		},
+		{
+			name:     "svtav1 retries its one pass",
+			script:   compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 3000, Encoders: []string{"libsvtav1"}},
+			opts:     Options{TargetMB: 2, Codec: CodecSVTAV1, MaxRetries: 1},
+			size:     3000 << 10,
+			attempts: 2,
+			over:     true,
+			commands: []string{"ffprobe", "ffmpeg -hide_banner -encoders", "ffmpeg -y", "ffmpeg -y"},
+		},
+		{
+			name:     "tiny target is clamped with a warning",
+			script:   compresstest.Script{Duration: "600", Size: 5 << 20, Progress: progress, OutputKB: 10},
+			opts:     Options{TargetMB: 0.1},
+			size:     10 << 10,
+			attempts: 1,
+			warning:  "video bitrate clamped",
+		},
+		{
+			name:     "over target retries pass 2",
+			script:   compresstest.Script{Duration: "20.5", Size: 5 << 20, Progress: progress, OutputKB: 3000},
+			opts:     Options{TargetMB: 2, MaxRetries: 2},
+			size:     3000 << 10,
+			attempts: 3,
+			over:     true,
+			commands: []string{"ffprobe", "ffmpeg", "ffmpeg", "ffmpeg", "ffmpeg"},
+		},
+		{
+			// The fake input has no moov box, so it is remuxed to move it
+			// to the front rather than copied.
+			name:     "input within the target is remuxed",
+			script:   compresstest.Script{Duration: "20.5", Size: 18, OutputKB: 1},
+			opts:     Options{TargetMB: 2},
+			size:     1 << 10,
+			commands: []string{"ffprobe", "ffmpeg -y -nostats -progress pipe:1 -i"},
+		},
+		{
+			name:     "input within the target with its index first is copied",
+			script:   compresstest.Script{Duration: "20.5", Size: int64(len(moovFirstMP4))},
+			input:    moovFirstMP4,
+			opts:     Options{TargetMB: 2},
+			size:     int64(len(moovFirstMP4)),
+			commands: []string{"ffprobe"},
+		},
+		{
+			name:     "input within the target keeps its audio tracks by remuxing",
+			script:   compresstest.Script{Duration: "20.5", Size: 18, MoreAudio: 1, OutputKB: 1},
+			opts:     Options{TargetMB: 2, AudioMode: AudioKeep},
+			size:     1 << 10,
+			commands: []string{"ffprobe", "ffmpeg -y -nostats -progress pipe:1 -i"},
+		},
+		{
+			name:     "second audio track is encoded instead of remuxed",
+			script:   compresstest.Script{Duration: "20.5", Size: 18, MoreAudio: 1, OutputKB: 1},
+			opts:     Options{TargetMB: 2, AudioTrack: 1},
+			size:     1 << 10,
+			attempts: 1,
+			commands: []string{"ffprobe", "ffmpeg -y", "ffmpeg -y"},
+		},
+		{
+			name:     "extra audio track is dropped by an encode instead of a copy",
+			script:   compresstest.Script{Duration: "20.5", Size: int64(len(moovFirstMP4)), MoreAudio: 1, OutputKB: 1},
+			input:    moovFirstMP4,
+			opts:     Options{TargetMB: 2},
+			size:     1 << 10,
+			attempts: 1,
+			commands: []string{"ffprobe", "ffmpeg -y", "ffmpeg -y"},
+		},
+		{
+			// The failed remux leaves no log, as the job recovers from it.
+			name:     "failed remux is replaced by an encode",
+			script:   compresstest.Script{Duration: "20.5", Size: 18, OutputKB: 1, FailRemux: true},
+			opts:     Options{TargetMB: 2},
+			size:     1 << 10,
+			attempts: 1,
+			commands: []string{"ffprobe", "ffmpeg -y -nostats -progress pipe:1 -i", "ffmpeg -y", "ffmpeg -y"},
+			warning:  "encoding instead",
+		},
+		{
+			name:     "zero target",
+			opts:     Options{TargetMB: 0},
+			err:      ErrInvalidTarget,
+			commands: []string{},
+		},
+		{
+			name:     "infinite target",
+			opts:     Options{TargetMB: math.Inf(1)},
+			err:      ErrInvalidTarget,
+			commands: []string{},
+		},
+		{
+			name:    "ffprobe fails",
+			script:  compresstest.Script{ProbeFail: true},
+			opts:    Options{TargetMB: 2},
+			err:     ErrInputNotFound,
+			errText: "No such file or directory",
+		},
+		{
+			name:    "N/A duration",
+			script:  compresstest.Script{Duration: "N/A", Size: 5 << 20},
+			opts:    Options{TargetMB: 2},
+			errText: "unknown duration",
+		},
+		{
+			name:    "zero duration",
+			script:  compresstest.Script{Duration: "0", Size: 5 << 20},
+			opts:    Options{TargetMB: 2},
+			errText: "unknown duration",
+		},
+		{
+			name:   "audio-only input",
+			script: compresstest.Script{Duration: "20.5", Size: 5 << 20, NoVideo: true},
+			opts:   Options{TargetMB: 2},
+			err:    ErrNoVideo,
+		},
+		{
+			name:   "trim past the end",
+			script: compresstest.Script{Duration: "20.5", Size: 5 << 20},
+			opts:   Options{TargetMB: 2, Start: 30},
+			err:    ErrInvalidTrim,
+		},
+		{
+			name:   "pass 1 fails",
+			script: compresstest.Script{Duration: "20.5", Size: 5 << 20, Progress: progress, FailPass: 1},
+			opts:   Options{TargetMB: 2},
+			pass:   1,
+		},
+		{
+			name:   "pass 2 fails",
+			script: compresstest.Script{Duration: "20.5", Size: 5 << 20, Progress: progress, FailPass: 2, OutputKB: 10},
+			opts:   Options{TargetMB: 2},
+			pass:   2,
+		},
+		{
+			name: "disk full",
+			script: compresstest.Script{Duration: "20.5", Size: 5 << 20, Progress: progress, FailPass: 2,
+				Stderr: "[out#0/mp4 @ 0x1] Error writing trailer: No space left on device\n"},
+			opts: Options{TargetMB: 2},
+			err:  ErrDiskFull,
+			pass: 2,
+		},
+		{
+			name: "encoder missing from the build",
+			script: compresstest.Script{Duration: "20.5", Size: 5 << 20, FailPass: 1,
+				Stderr: "[vost#0:0 @ 0x1] Unknown encoder 'libx264'\n"},
+			opts: Options{TargetMB: 2},
+			err:  ErrEncoderUnavailable,
+			pass: 1,
+		},
+		{
+			name:   "missing encoder",
+			script: compresstest.Script{Duration: "20.5", Size: 5 << 20},
+			opts:   Options{TargetMB: 2, Codec: CodecVP9},
+			err:    ErrEncoderUnavailable,
+		},
+		{
+			name:   "cancelled",
+			script: compresstest.Script{Duration: "20.5", Size: 5 << 20, Progress: progress, OutputKB: 10},
+			opts:   Options{TargetMB: 2},
+			ctx: func() context.Context {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx
+			},
+			err: context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, input := compresstest.New(t, tt.script)
+			if tt.input != nil {
+				if err := os.WriteFile(input, tt.input, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dir := filepath.Dir(input)
+			opts := tt.opts
+			opts.Input, opts.Output, opts.Runner = input, filepath.Join(dir, "output.mp4"), runner
+			opts.TempDir = t.TempDir()
+			var warnings []string
+			opts.OnEvent = func(e Event) {
+				if e.Kind == EventWarning {
+					warnings = append(warnings, e.Message)
+				}
+			}
+			ctx := context.Background()
+			if tt.ctx != nil {
+				ctx = tt.ctx()
+			}
+
+			res, err := Compress(ctx, opts)
+			failing := tt.err != nil || tt.errText != "" || tt.pass != 0
+			switch {
+			case tt.err != nil && !errors.Is(err, tt.err):
+				t.Fatalf("Compress() error = %v, want %v", err, tt.err)
+			case tt.errText != "":
+				var probeErr *ProbeError
+				if !errors.As(err, &probeErr) || !strings.Contains(err.Error(), tt.errText) {
+					t.Fatalf("Compress() error = %v, want a ProbeError containing %q", err, tt.errText)
+				}
+			case tt.pass != 0:
+				var passErr *PassError
+				if !errors.As(err, &passErr) || passErr.Pass != tt.pass {
+					t.Fatalf("Compress() error = %v, want a PassError for pass %d", err, tt.pass)
+				}
+			case !failing && err != nil:
+				t.Fatalf("Compress() error = %v", err)
+			}
+
+			if failing {
+				// A failed job leaves nothing behind but the input, and the
+				// log of a failed pass.
+				entries, _ := os.ReadDir(dir)
+				for _, entry := range entries {
+					name := entry.Name()
+					if name == "input.mp4" || name == "commands.log" || tt.pass != 0 && name == "output.ffmpeg.log" {
+						continue
+					}
+					t.Errorf("left behind %s", name)
+				}
+			}
+			if tt.pass != 0 {
+				log := filepath.Join(dir, "output.ffmpeg.log")
+				data, readErr := os.ReadFile(log)
+				if readErr != nil || !strings.HasPrefix(string(data), "ffmpeg -y") || !strings.Contains(string(data), "Conversion failed!") {
+					t.Errorf("log = %q, %v; want the command line and stderr", data, readErr)
+				}
+				if !strings.Contains(err.Error(), log) {
+					t.Errorf("Compress() error = %v, want it to name %s", err, log)
+				}
+			}
+			if !failing {
+				if _, err := os.Stat(filepath.Join(dir, "output.ffmpeg.log")); err == nil {
+					t.Errorf("a job that succeeded left output.ffmpeg.log behind")
+				}
+				if res.Size != tt.size || res.Attempts != tt.attempts || res.OverTarget != tt.over {
+					t.Errorf("Result = size %d, %d attempts, over %v; want %d, %d, %v",
+						res.Size, res.Attempts, res.OverTarget, tt.size, tt.attempts, tt.over)
+				}
+				if stat, err := os.Stat(opts.Output); err != nil || stat.Size() != tt.size {
+					t.Errorf("output: %v, want %d bytes", err, tt.size)
+				}
+			}
+
+			if tt.commands != nil {
+				got := runner.Commands(t)
+				if len(got) != len(tt.commands) {
+					t.Fatalf("ran %d commands, want %d:\n%s", len(got), len(tt.commands), strings.Join(got, "\n"))
+				}
+				for i, prefix := range tt.commands {
+					if !strings.HasPrefix(got[i], prefix) {
+						t.Errorf("command %d = %q, want it to start with %q", i, got[i], prefix)
+					}
+				}
+			}
+			if tt.warning != "" && !strings.Contains(strings.Join(warnings, "\n"), tt.warning) {
+				t.Errorf("warnings %q do not mention %q", warnings, tt.warning)
+			}
+		})
+	}
+}
+
+func TestCompressPassArgs(t *testing.T) {
+	runner, input := compresstest.New(t, compresstest.Script{Duration: "60", Size: 50 << 20, OutputKB: 1})
+	opts := Options{Input: input, Output: filepath.Join(filepath.Dir(input), "out.mp4"), TargetMB: 10, Runner: runner, TempDir: t.TempDir()}
+	if _, err := Compress(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// 10 MB over 60 seconds, less the overhead and 128 kbps of audio.
+	commands := runner.Commands(t)
+	if len(commands) != 3 {
+		t.Fatalf("ran %d commands, want 3", len(commands))
+	}
+	for i, want := range []string{"-b:v 1196k -c:v libx264 -pass 1", "-b:v 1196k -c:v libx264 -pass 2"} {
+		if !strings.Contains(commands[i+1], want) {
+			t.Errorf("pass %d: %q does not contain %q", i+1, commands[i+1], want)
+		}
+	}
+	if !strings.Contains(commands[1], "-an -f null") || !strings.Contains(commands[2], "-c:a aac -b:a:0 128k") {
+		t.Errorf("unexpected audio arguments:\n%s", strings.Join(commands, "\n"))
+	}
+}
+
+func TestCompressOutputMode(t *testing.T) {
+	// The output gets the mode os.Create gives a new file under the
+	// current umask, not the owner-only mode of a temporary file.
+	probe := filepath.Join(t.TempDir(), "probe")
+	f, err := os.Create(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	stat, err := os.Stat(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := stat.Mode().Perm()
+
+	tests := []struct {
+		name   string
+		script compresstest.Script
+		opts   Options
+	}{
+		{name: "encoded", script: compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 1024}, opts: Options{TargetMB: 2}},
+		{name: "remuxed", script: compresstest.Script{Duration: "20.5", Size: 18, OutputKB: 1}, opts: Options{TargetMB: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, input := compresstest.New(t, tt.script)
+			opts := tt.opts
+			opts.Input, opts.Output, opts.Runner = input, filepath.Join(filepath.Dir(input), "output.mp4"), runner
+			opts.TempDir = t.TempDir()
+			if _, err := Compress(context.Background(), opts); err != nil {
+				t.Fatal(err)
+			}
+			stat, err := os.Stat(opts.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stat.Mode().Perm(); got != want {
+				t.Errorf("output mode = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestCodecFallbackContainer(t *testing.T) {
+	runner, input := compresstest.New(t, compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 1024})
+	opts := Options{Input: input, TargetMB: 2, Codec: CodecVP9, CodecFallback: true, Runner: runner, TempDir: t.TempDir()}
+
+	codec, err := ResolveCodec(context.Background(), opts)
+	if err != nil || codec != CodecX264 {
+		t.Fatalf("ResolveCodec() = %v, %v; want %v", codec, err, CodecX264)
+	}
+
+	// A WebM output cannot hold the H.264 the job falls back to.
+	opts.Output = filepath.Join(filepath.Dir(input), "output.webm")
+	if _, err := Compress(context.Background(), opts); !errors.Is(err, ErrEncoderUnavailable) {
+		t.Errorf("Compress() to %s error = %v, want %v", opts.Output, err, ErrEncoderUnavailable)
+	}
+	opts.Output = filepath.Join(filepath.Dir(input), "output"+codec.Ext())
+	if _, err := Compress(context.Background(), opts); err != nil {
+		t.Errorf("Compress() to %s error = %v", opts.Output, err)
+	}
+}
@@ -0,0 +1,240 @@
+// Package compresstest provides a fake ffmpeg and ffprobe for testing code
+// that runs them through a compress.Runner. The fakes are the test binary
+// itself, run again with a Script, so a package using them must call Main
+// from its TestMain.
+package compresstest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// scriptEnv carries the Script to the test binary when Runner runs it in
+// place of ffmpeg or ffprobe.
+const scriptEnv = "MP4_COMPRESS_FAKE_SCRIPT"
+
+// Script tells the fake ffmpeg and ffprobe what to do.
+type Script struct {
+	Duration   string     // format duration ffprobe reports, e.g. "20.5" or "N/A"
+	Size       int64      // input size ffprobe reports
+	NoVideo    bool       // ffprobe reports no video stream
+	NoAudio    bool       // ffprobe reports no audio stream
+	MoreAudio  int        // audio streams ffprobe reports after the first
+	ProbeFail  bool       // ffprobe exits with status 1
+	Keyframes  []float64  // keyframe times ffprobe lists for -skip_frame nokey
+	Encoders   []string   // what ffmpeg -encoders lists besides libx264 and aac
+	Progress   []float64  // out_time, in seconds, of each -progress block
+	FailPass   int        // ffmpeg exits with status 1 in this pass (0 for none, -1 for every run)
+	FailRemux  bool       // ffmpeg exits with status 1 when it copies the streams
+	Stderr     string     // what ffmpeg prints before it fails
+	OutputKB   int        // size of the output file ffmpeg writes
+	OutputIf   []SizeRule // sizes that replace OutputKB for some commands
+	SSIMPerCRF float64    // measured SSIM is 1 - CRF*SSIMPerCRF for a -crf encode
+	Log        string     // file every command line is appended to
+}
+
+// SizeRule sets the size of the output ffmpeg writes when one of its
+// arguments contains Arg. The first matching rule wins over OutputKB.
+type SizeRule struct {
+	Arg string
+	KB  int
+}
+
+// crfTag starts an output written by a -crf encode, so that measuring it
+// knows the CRF.
+const crfTag = "crf="
+
+// Runner runs the test binary as ffmpeg and ffprobe, following Script. It
+// implements compress.Runner.
+type Runner struct {
+	Script Script
+}
+
+func (f Runner) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	script, err := json.Marshal(f.Script)
+	if err != nil {
+		panic(err)
+	}
+	cmd := exec.CommandContext(ctx, os.Args[0], append([]string{name}, args...)...)
+	cmd.Env = append(os.Environ(), scriptEnv+"="+string(script))
+	return cmd
+}
+
+// Commands returns the command lines the fake has logged.
+func (f Runner) Commands(t testing.TB) []string {
+	t.Helper()
+	data, err := os.ReadFile(f.Script.Log)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// New returns a Runner for script that logs to a file in a test directory,
+// and an input file in that directory.
+func New(t testing.TB, script Script) (Runner, string) {
+	t.Helper()
+	dir := t.TempDir()
+	script.Log = filepath.Join(dir, "commands.log")
+	input := filepath.Join(dir, "input.mp4")
+	if err := os.WriteFile(input, []byte("not really a video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Runner{Script: script}, input
+}
+
+// Main runs the fake ffmpeg or ffprobe when the test binary was started by
+// a Runner, and the tests otherwise.
+func Main(m *testing.M) {
+	if script := os.Getenv(scriptEnv); script != "" {
+		os.Exit(runFake(script, os.Args[1], os.Args[2:]))
+	}
+	os.Exit(m.Run())
+}
+
+// runFake is the main function of the fake ffmpeg and ffprobe.
+func runFake(scriptJSON, name string, args []string) int {
+	var script Script
+	if err := json.Unmarshal([]byte(scriptJSON), &script); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if script.Log != "" {
+		f, err := os.OpenFile(script.Log, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		fmt.Fprintln(f, name, strings.Join(args, " "))
+		f.Close()
+	}
+
+	if name == "ffprobe" {
+		return fakeProbe(script, args)
+	}
+	if slices.Contains(args, "-encoders") {
+		fmt.Println("Encoders:\n V..... = Video\n ------")
+		for _, encoder := range append([]string{"libx264", "aac"}, script.Encoders...) {
+			fmt.Printf(" V....D %-20s fake\n", encoder)
+		}
+		return 0
+	}
+
+	pass := 0
+	for i, arg := range args[:len(args)-1] {
+		switch arg {
+		case "-pass":
+			fmt.Sscan(args[i+1], &pass)
+		case "-passlogfile":
+			os.WriteFile(args[i+1]+"-0.log", []byte("stats\n"), 0644)
+		}
+	}
+	for _, t := range script.Progress {
+		fmt.Printf("frame=1\nout_time_us=%.0f\nspeed=2x\nprogress=continue\n", t*1e6)
+	}
+	fmt.Println("progress=end")
+	remux := strings.Contains(strings.Join(args, " "), "-c copy")
+	if script.FailPass != 0 && (script.FailPass == pass || script.FailPass == -1) || script.FailRemux && remux {
+		fmt.Fprint(os.Stderr, script.Stderr)
+		fmt.Fprintln(os.Stderr, "Conversion failed!")
+		return 1
+	}
+	if slices.ContainsFunc(args, func(arg string) bool { return strings.Contains(arg, "ssim") }) {
+		return fakeMeasure(script, args)
+	}
+	if output := args[len(args)-1]; output != os.DevNull {
+		if err := os.WriteFile(output, fakeOutput(script, args), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// fakeOutput is what the fake ffmpeg writes for args: OutputKB, or the size
+// of the first SizeRule that matches, starting with the CRF of a -crf encode.
+func fakeOutput(script Script, args []string) []byte {
+	kb := script.OutputKB
+	for _, rule := range script.OutputIf {
+		if slices.ContainsFunc(args, func(arg string) bool { return strings.Contains(arg, rule.Arg) }) {
+			kb = rule.KB
+			break
+		}
+	}
+	data := make([]byte, kb*1024)
+	if i := slices.Index(args, "-crf"); i >= 0 {
+		tag := []byte(crfTag + args[i+1] + "\n")
+		if len(tag) > len(data) {
+			data = tag
+		}
+		copy(data, tag)
+	}
+	return data
+}
+
+// fakeMeasure prints the summary lines of ffmpeg's ssim and psnr filters for
+// the output given as the first input.
+func fakeMeasure(script Script, args []string) int {
+	data, err := os.ReadFile(args[slices.Index(args, "-i")+1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var crf float64
+	if line, _, _ := strings.Cut(string(data), "\n"); strings.HasPrefix(line, crfTag) {
+		fmt.Sscan(strings.TrimPrefix(line, crfTag), &crf)
+	}
+	fmt.Fprintf(os.Stderr, "[Parsed_ssim_0 @ 0x1] SSIM Y:0.9 U:0.9 V:0.9 All:%f (20.0)\n", 1-crf*script.SSIMPerCRF)
+	fmt.Fprintln(os.Stderr, "[Parsed_psnr_1 @ 0x1] PSNR y:40.0 u:40.0 v:40.0 average:40.000000 min:30.0 max:50.0")
+	return 0
+}
+
+func fakeProbe(script Script, args []string) int {
+	path := args[len(args)-1]
+	if script.ProbeFail {
+		fmt.Fprintf(os.Stderr, "%s: No such file or directory\n", path)
+		return 1
+	}
+	if slices.Contains(args, "nokey") {
+		for _, t := range script.Keyframes {
+			fmt.Printf("%.6f\n", t)
+		}
+		return 0
+	}
+	var streams []map[string]any
+	if !script.NoVideo {
+		streams = append(streams, map[string]any{
+			"index": 0, "codec_type": "video", "codec_name": "h264",
+			"width": 1280, "height": 720, "avg_frame_rate": "30/1",
+		})
+	}
+	if !script.NoAudio {
+		for range 1 + script.MoreAudio {
+			streams = append(streams, map[string]any{
+				"index": len(streams), "codec_type": "audio", "codec_name": "aac",
+				"channels": 2, "sample_rate": "48000", "bit_rate": "128000",
+			})
+		}
+	}
+	out := map[string]any{
+		"format": map[string]any{
+			"format_name": "mov,mp4,m4a,3gp,3g2,mj2",
+			"duration":    script.Duration,
+			"size":        fmt.Sprint(script.Size),
+			"bit_rate":    "N/A",
+		},
+		"streams": streams,
+	}
+	json.NewEncoder(os.Stdout).Encode(out)
+	return 0
+}
@@ -0,0 +1,44 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidTarget is returned when the requested size is not positive.
+	ErrInvalidTarget = errors.New("target size must be greater than 0 MB")
+	// ErrInvalidTrim is wrapped by every error about the start/end range.
+	ErrInvalidTrim = errors.New("invalid trim range")
+	// ErrNoVideo is returned for an input without a video stream.
+	ErrNoVideo = errors.New("no video stream")
+)
+
+// ProbeError reports a failure to read the input with ffprobe.
+type ProbeError struct {
+	Path string
+	Err  error
+}
+
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf("probing %s: %v", e.Path, e.Err)
+}
+
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+// PassError reports a failed ffmpeg pass. When the context was cancelled Err
+// is the context's error, so errors.Is(err, context.Canceled) holds.
+type PassError struct {
+	Pass int
+	Err  error
+}
+
+func (e *PassError) Error() string {
+	return fmt.Sprintf("pass %d failed: %v", e.Pass, e.Err)
+}
+
+func (e *PassError) Unwrap() error {
+	return e.Err
+}
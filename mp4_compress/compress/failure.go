@@ -0,0 +1,228 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// stderrTail is how much of the end of ffmpeg's and ffprobe's stderr is kept
+// for classifying a failure and writing its log.
+const stderrTail = 256 << 10
+
+var (
+	// ErrToolNotFound means ffmpeg or ffprobe could not be started; the
+	// ToolError names which.
+	ErrToolNotFound = errors.New("tool not found")
+	// ErrInputNotFound means ffmpeg could not open the input.
+	ErrInputNotFound = errors.New("input not found")
+	// ErrUnsupportedInput means the input is damaged or in a format or
+	// codec ffmpeg cannot decode.
+	ErrUnsupportedInput = errors.New("unsupported input")
+	// ErrDiskFull means ffmpeg ran out of space writing the output.
+	ErrDiskFull = errors.New("disk full")
+	// ErrPermissionDenied means ffmpeg was not allowed to read the input
+	// or write the output.
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// failurePatterns map lines of ffmpeg and ffprobe output to the errors they
+// mean. The first pattern found in the output wins.
+var failurePatterns = []struct {
+	text string
+	err  error
+}{
+	{"No space left on device", ErrDiskFull},
+	{"Disk quota exceeded", ErrDiskFull},
+	{"Permission denied", ErrPermissionDenied},
+	{"Unknown encoder", ErrEncoderUnavailable},
+	{"Encoder not found", ErrEncoderUnavailable},
+	{"Encoder (codec", ErrEncoderUnavailable},
+	{"Decoder (codec", ErrUnsupportedInput},
+	{"Invalid data found when processing input", ErrUnsupportedInput},
+	{"could not find codec parameters", ErrUnsupportedInput},
+	{"Output file is empty, nothing was encoded", ErrInvalidTrim},
+	{"No such file or directory", ErrInputNotFound},
+}
+
+// failureHints say what to do about each kind of failure.
+var failureHints = map[error]string{
+	ErrToolNotFound:       "install ffmpeg and make sure ffmpeg and ffprobe are on the PATH",
+	ErrInputNotFound:      "check that the input file exists and its path is spelled correctly",
+	ErrUnsupportedInput:   "the input is damaged or uses a format this ffmpeg build cannot decode",
+	ErrEncoderUnavailable: "choose another codec or use an ffmpeg build that includes this encoder",
+	ErrDiskFull:           "free up space on the output drive or write the output elsewhere",
+	ErrPermissionDenied:   "check that the input can be read and the output folder can be written",
+	ErrInvalidTrim:        "check that the start and end lie within the video",
+}
+
+// ToolError reports a failed ffmpeg or ffprobe run. Kind is the cause
+// recognised in its output, such as ErrDiskFull, or nil if there was none;
+// errors.Is matches both Kind and Err.
+type ToolError struct {
+	Tool string // "ffmpeg" or "ffprobe"
+	Kind error
+	Line string // the line of output that showed Kind, or the last one
+	Log  string // where the output was saved, if it was
+	Err  error  // the error from running the command
+
+	// args and stderr are kept for logFailure until the log is written.
+	args   []string
+	stderr *ringBuffer
+}
+
+func (e *ToolError) Error() string {
+	var b strings.Builder
+	if e.Kind != nil {
+		b.WriteString(e.Kind.Error())
+	} else {
+		fmt.Fprintf(&b, "%s failed: %v", e.Tool, e.Err)
+	}
+	if e.Line != "" {
+		b.WriteString(": " + e.Line)
+	}
+	if hint := failureHints[e.Kind]; hint != "" {
+		b.WriteString("; " + hint)
+	}
+	if e.Log != "" {
+		fmt.Fprintf(&b, " (full log: %s)", e.Log)
+	}
+	return b.String()
+}
+
+func (e *ToolError) Unwrap() []error {
+	if e.Kind != nil {
+		return []error{e.Kind, e.Err}
+	}
+	return []error{e.Err}
+}
+
+// classifyFailure builds the ToolError for a failed run of tool, started
+// from the binary at path, from its error and the end of its stderr.
+func classifyFailure(tool, path string, err error, stderr []byte) *ToolError {
+	e := &ToolError{Tool: tool, Err: err}
+	// A binary missing from the PATH, or from the path an ExecRunner names;
+	// a missing working directory fails the same way but names the directory.
+	var execErr *exec.Error
+	var pathErr *fs.PathError
+	if errors.As(err, &execErr) || errors.As(err, &pathErr) && pathErr.Path == path && errors.Is(err, fs.ErrNotExist) {
+		e.Kind, e.Line = ErrToolNotFound, fmt.Sprintf("%s: %v", tool, err)
+		return e
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(stderr))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && line != "Conversion failed!" {
+			lines = append(lines, line)
+		}
+	}
+	for _, p := range failurePatterns {
+		if i := slices.IndexFunc(lines, func(line string) bool { return strings.Contains(line, p.text) }); i >= 0 {
+			e.Kind, e.Line = p.err, lines[i]
+			return e
+		}
+	}
+	if len(lines) > 0 {
+		e.Line = lines[len(lines)-1]
+	}
+	return e
+}
+
+// logFailure writes the log of the failed ffmpeg run behind err, if it has
+// one that was not written yet. It is only called once a failure reaches
+// the caller, so runs a job recovers from, such as a remux it replaces with
+// an encode, leave no log behind.
+func (opts Options) logFailure(err error) error {
+	var failure *ToolError
+	if errors.As(err, &failure) && failure.stderr != nil {
+		failure.Log = opts.writeLog(failure.args, failure.stderr)
+		failure.args, failure.stderr = nil, nil
+	}
+	return err
+}
+
+// writeLog saves the stderr of a failed ffmpeg run, with its command line,
+// as <output name>.ffmpeg.log in opts.LogDir or next to opts.Output, and
+// returns the path, or "" if it could not be written.
+func (opts Options) writeLog(args []string, stderr *ringBuffer) string {
+	if opts.Output == "" {
+		return ""
+	}
+	dir := opts.LogDir
+	if dir == "" {
+		dir = filepath.Dir(opts.Output)
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return ""
+	}
+	name := strings.TrimSuffix(filepath.Base(opts.Output), filepath.Ext(opts.Output)) + ".ffmpeg.log"
+	path, err := filepath.Abs(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+
+	var b bytes.Buffer
+	b.WriteString("ffmpeg")
+	for _, arg := range args {
+		if strings.ContainsAny(arg, " \t\"'") {
+			arg = strconv.Quote(arg)
+		}
+		b.WriteString(" " + arg)
+	}
+	b.WriteString("\n\n")
+	if stderr.dropped {
+		b.WriteString("[earlier output dropped]\n")
+	}
+	b.Write(stderr.Bytes())
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return ""
+	}
+	return path
+}
+
+// ringBuffer keeps the last len(data) bytes written to it.
+type ringBuffer struct {
+	data    []byte
+	pos     int  // where the next byte goes
+	full    bool // every byte of data has been written
+	dropped bool // older bytes were overwritten or never kept
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{data: make([]byte, size)}
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > len(r.data) {
+		p, r.dropped = p[len(p)-len(r.data):], true
+	}
+	for len(p) > 0 {
+		if r.full {
+			r.dropped = true
+		}
+		copied := copy(r.data[r.pos:], p)
+		p = p[copied:]
+		r.pos += copied
+		if r.pos == len(r.data) {
+			r.pos, r.full = 0, true
+		}
+	}
+	return n, nil
+}
+
+// Bytes returns what the buffer holds, oldest first.
+func (r *ringBuffer) Bytes() []byte {
+	if !r.full {
+		return slices.Clone(r.data[:r.pos])
+	}
+	return append(slices.Clone(r.data[r.pos:]), r.data[:r.pos]...)
+}
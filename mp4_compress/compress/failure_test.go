@@ -0,0 +1,141 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	exit := errors.New("exit status 1")
+	tests := []struct {
+		name   string
+		tool   string
+		path   string
+		err    error
+		stderr string
+		kind   error
+		line   string
+	}{
+		{
+			name:   "missing input",
+			stderr: "[in#0 @ 0x1] Error opening input: No such file or directory\nError opening input file clip.mp4.\n",
+			kind:   ErrInputNotFound,
+			line:   "[in#0 @ 0x1] Error opening input: No such file or directory",
+		},
+		{
+			name:   "damaged input",
+			stderr: "clip.mp4: Invalid data found when processing input\n",
+			kind:   ErrUnsupportedInput,
+			line:   "clip.mp4: Invalid data found when processing input",
+		},
+		{
+			name:   "old ffmpeg without the encoder",
+			stderr: "Encoder (codec hevc) not found for output stream #0:0\n",
+			kind:   ErrEncoderUnavailable,
+			line:   "Encoder (codec hevc) not found for output stream #0:0",
+		},
+		{
+			name:   "disk full wins over the missing file it causes",
+			stderr: "av_interleaved_write_frame(): No space left on device\nout.mp4: No such file or directory\nConversion failed!\n",
+			kind:   ErrDiskFull,
+			line:   "av_interleaved_write_frame(): No space left on device",
+		},
+		{
+			name:   "permission denied",
+			stderr: "out.mp4: Permission denied\n",
+			kind:   ErrPermissionDenied,
+			line:   "out.mp4: Permission denied",
+		},
+		{
+			name:   "trim past the end",
+			stderr: "Output file is empty, nothing was encoded (check -ss / -t / -frames parameters if used)\n",
+			kind:   ErrInvalidTrim,
+			line:   "Output file is empty, nothing was encoded (check -ss / -t / -frames parameters if used)",
+		},
+		{
+			name:   "unrecognised output keeps the last line",
+			stderr: "something odd happened\n\nConversion failed!\n",
+			line:   "something odd happened",
+		},
+		{
+			name: "ffmpeg not installed",
+			err:  &exec.Error{Name: "ffmpeg", Err: exec.ErrNotFound},
+			kind: ErrToolNotFound,
+			line: `ffmpeg: exec: "ffmpeg": executable file not found in $PATH`,
+		},
+		{
+			name: "ffprobe not installed",
+			tool: "ffprobe",
+			err:  &exec.Error{Name: "ffprobe", Err: exec.ErrNotFound},
+			kind: ErrToolNotFound,
+			line: `ffprobe: exec: "ffprobe": executable file not found in $PATH`,
+		},
+		{
+			name: "configured ffmpeg path missing",
+			path: "/opt/ffmpeg/bin/ffmpeg",
+			err:  &fs.PathError{Op: "fork/exec", Path: "/opt/ffmpeg/bin/ffmpeg", Err: syscall.ENOENT},
+			kind: ErrToolNotFound,
+			line: "ffmpeg: fork/exec /opt/ffmpeg/bin/ffmpeg: no such file or directory",
+		},
+		{
+			name: "missing working directory",
+			path: "/usr/bin/ffmpeg",
+			err:  &fs.PathError{Op: "chdir", Path: "/tmp/gone", Err: syscall.ENOENT},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.err
+			if err == nil {
+				err = exit
+			}
+			tool := tt.tool
+			if tool == "" {
+				tool = "ffmpeg"
+			}
+			got := classifyFailure(tool, tt.path, err, []byte(tt.stderr))
+			if got.Kind != tt.kind || got.Line != tt.line {
+				t.Fatalf("classifyFailure() = %v, %q; want %v, %q", got.Kind, got.Line, tt.kind, tt.line)
+			}
+			if !errors.Is(got, err) || tt.kind != nil && !errors.Is(got, tt.kind) {
+				t.Errorf("errors.Is(%v) does not match both %v and %v", got, err, tt.kind)
+			}
+			if hint := failureHints[tt.kind]; !strings.Contains(got.Error(), hint) {
+				t.Errorf("Error() = %q, want the hint %q", got.Error(), hint)
+			}
+		})
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	r := newRingBuffer(8)
+	fmt.Fprint(r, "abc")
+	if got := string(r.Bytes()); got != "abc" || r.dropped {
+		t.Fatalf("Bytes() = %q, dropped %v; want %q", got, r.dropped, "abc")
+	}
+	// Filling the buffer exactly drops nothing.
+	fmt.Fprint(r, "defgh")
+	if got := string(r.Bytes()); got != "abcdefgh" || r.dropped {
+		t.Fatalf("Bytes() = %q, dropped %v; want %q", got, r.dropped, "abcdefgh")
+	}
+	fmt.Fprint(r, "ij")
+	if got := string(r.Bytes()); got != "cdefghij" || !r.dropped {
+		t.Fatalf("Bytes() = %q, dropped %v; want %q", got, r.dropped, "cdefghij")
+	}
+	fmt.Fprint(r, "0123456789xyz")
+	if got := string(r.Bytes()); got != "56789xyz" {
+		t.Fatalf("Bytes() = %q, want %q", got, "56789xyz")
+	}
+
+	r = newRingBuffer(8)
+	fmt.Fprint(r, "0123456789")
+	if got := string(r.Bytes()); got != "23456789" || !r.dropped {
+		t.Fatalf("Bytes() = %q, dropped %v; want %q", got, r.dropped, "23456789")
+	}
+}
@@ -0,0 +1,182 @@
+package compress
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Action is what Compress did to produce the output.
+type Action string
+
+const (
+	// ActionEncode re-encoded the input.
+	ActionEncode Action = "encode"
+	// ActionCopy copied the input unchanged, as it already fit the target.
+	ActionCopy Action = "copy"
+	// ActionRemux copied the streams of the input into a new container,
+	// moving the MP4 index to the front, as it already fit the target.
+	ActionRemux Action = "remux"
+)
+
+// faststartExts are the containers ffmpeg's -movflags +faststart applies to.
+var faststartExts = []string{".mp4", ".m4v", ".mov"}
+
+// fitsTarget reports whether the input can be used as it is: it is already
+// within opts.TargetMB and none of the options ask for changes only an
+// encode can make.
+func fitsTarget(opts Options, info *MediaInfo) bool {
+	if opts.TargetMB <= 0 || opts.CRF != 0 || opts.MinSSIM != 0 {
+		return false
+	}
+	if info.Size <= 0 || info.Size > int64(opts.TargetMB*1024*1024) {
+		return false
+	}
+	if opts.Start != 0 || opts.End != 0 || opts.Duration != 0 {
+		return false
+	}
+	if opts.AudioMode == AudioStereo || (opts.AudioMode == AudioNone && info.HasAudio()) {
+		return false
+	}
+	// Only AudioKeep keeps every audio track; the other modes keep one.
+	if opts.AudioTrack != 0 || (opts.AudioMode != AudioKeep && len(info.Audio) > 1) {
+		return false
+	}
+	if len(info.Video) > 0 {
+		opts.NoAutoScale = true
+		if w, _, fps := planScale(opts, info.Video[0], 0, 1); w != 0 || fps != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// keep produces opts.Output from an input that already fits the target,
+// copying it when it is usable as it is and remuxing it otherwise. A
+// failed remux, such as when the streams do not fit the output container,
+// is returned so the caller can encode instead.
+func keep(ctx context.Context, opts Options, info *MediaInfo) (*Result, error) {
+	input, err := absPath(opts.Input)
+	if err != nil {
+		return nil, err
+	}
+	output, err := absPath(opts.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	action := ActionCopy
+	outExt := strings.ToLower(filepath.Ext(output))
+	if !strings.EqualFold(filepath.Ext(input), outExt) {
+		action = ActionRemux
+	} else if slices.Contains(faststartExts, outExt) {
+		if first, err := moovFirst(input); err != nil || !first {
+			action = ActionRemux
+		}
+	}
+
+	res := &Result{
+		Info:   info,
+		Plan:   Plan{TargetMB: opts.TargetMB, End: info.Duration, Duration: info.Duration},
+		Output: output,
+		Action: action,
+	}
+	opts.emit(Event{Kind: EventKeep, Info: info, Plan: &res.Plan, Action: action})
+	if action == ActionCopy && input == output {
+		res.Size = info.Size
+		return res, nil
+	}
+
+	partial, err := partialFile(output)
+	if err != nil {
+		return nil, fmt.Errorf("creating output: %w", err)
+	}
+	defer os.Remove(partial)
+
+	if action == ActionCopy {
+		err = copyFile(input, partial)
+	} else {
+		args := []string{"-y", "-nostats", "-progress", "pipe:1", "-i", input, "-map", "0", "-c", "copy"}
+		if slices.Contains(faststartExts, outExt) {
+			args = append(args, "-movflags", "+faststart")
+		}
+		err = runFFmpeg(ctx, opts, append(args, partial), "", Progress{Pass: 1, Passes: 1, Duration: info.Duration})
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%s failed: %w", action, err)
+	}
+
+	stat, err := os.Stat(partial)
+	if err != nil {
+		return nil, fmt.Errorf("reading output: %w", err)
+	}
+	res.Size = stat.Size()
+	if err := os.Rename(partial, output); err != nil {
+		return nil, fmt.Errorf("moving output into place: %w", err)
+	}
+	return res, nil
+}
+
+// moovFirst reports whether the index ("moov" box) of an MP4 file comes
+// before its media data, so players can start before the whole file is
+// downloaded.
+func moovFirst(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var header [16]byte
+	for offset := int64(0); ; {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return false, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:8]) {
+		case "moov":
+			return true, nil
+		case "mdat":
+			return false, nil
+		}
+		switch size {
+		case 0: // the box runs to the end of the file
+			return false, errors.New("no moov box")
+		case 1: // a 64-bit size follows the type
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return false, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if size < 8 {
+			return false, errors.New("invalid box size")
+		}
+		offset += size
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
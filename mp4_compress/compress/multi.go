@@ -0,0 +1,136 @@
+package compress
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Target is one output of CompressTargets.
+type Target struct {
+	TargetMB float64
+	Output   string
+}
+
+// CompressTargets encodes opts.Input once for every target, sharing the
+// first pass between them: pass 1 runs once for each distinct output
+// resolution and frame rate the plans call for, then pass 2 runs per target
+// with its own bitrate. Encoders without two-pass support encode each target
+// in one pass. opts.TargetMB and opts.Output are ignored, and
+// opts.CRF and opts.MinSSIM must not be set.
+//
+// The results are in the order of targets, each with its own error; the
+// returned error is only set when nothing could be encoded at all.
+func CompressTargets(ctx context.Context, opts Options, targets []Target) ([]JobResult, error) {
+	if opts.CRF != 0 || opts.MinSSIM != 0 {
+		return nil, fmt.Errorf("%w: several targets need target-size mode", ErrInvalidTarget)
+	}
+	for _, t := range targets {
+		if t.TargetMB <= 0 || math.IsNaN(t.TargetMB) || math.IsInf(t.TargetMB, 0) {
+			return nil, ErrInvalidTarget
+		}
+	}
+
+	info, err := opts.probe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !info.HasVideo() {
+		return nil, fmt.Errorf("%w in %s", ErrNoVideo, opts.Input)
+	}
+	opts.Info = info
+	if opts, err = opts.settleCodec(ctx); err != nil {
+		return nil, err
+	}
+
+	results := make([]JobResult, len(targets))
+	plans := make([]Plan, len(targets))
+	// groups maps a video filter to the targets whose pass 1 is the same.
+	var filters []string
+	groups := make(map[string][]int)
+	for i, t := range targets {
+		o := opts
+		o.TargetMB, o.Output = t.TargetMB, t.Output
+		results[i].Options = o
+
+		if !o.Force && fitsTarget(o, info) {
+			res, err := keep(ctx, o, info)
+			if err == nil || IsCanceled(err) {
+				results[i].Result, results[i].Err = res, err
+				continue
+			}
+			o.emit(Event{Kind: EventWarning, Message: fmt.Sprintf("%s: %v; encoding instead", t.Output, err)})
+		}
+		if plans[i], err = NewPlan(o, info); err != nil {
+			results[i].Err = err
+			continue
+		}
+		filter := videoFilter(plans[i])
+		if _, ok := groups[filter]; !ok {
+			filters = append(filters, filter)
+		}
+		groups[filter] = append(groups[filter], i)
+	}
+
+	workDir, err := os.MkdirTemp(opts.TempDir, "mp4_compress-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating pass log directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+	if opts.Input, err = absPath(opts.Input); err != nil {
+		return nil, err
+	}
+
+	for _, filter := range filters {
+		group := groups[filter]
+		var err error
+		if plans[group[0]].Passes == Passes {
+			err = runPass(ctx, opts, plans[group[0]], 1, workDir, "")
+		}
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		for _, i := range group {
+			if err != nil {
+				results[i].Err = &PassError{Pass: 1, Err: err}
+				continue
+			}
+			o := results[i].Options
+			o.Input = opts.Input
+			results[i].Result, results[i].Err = encodeTarget(ctx, o, info, plans[i], workDir)
+		}
+	}
+	for i := range results {
+		results[i].Options.logFailure(results[i].Err)
+	}
+	return results, nil
+}
+
+// encodeTarget runs the last pass of plan, reusing any pass 1 stats in
+// workDir, and moves the output into place.
+func encodeTarget(ctx context.Context, opts Options, info *MediaInfo, plan Plan, workDir string) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	output, err := absPath(opts.Output)
+	if err != nil {
+		return nil, err
+	}
+	partial, err := partialFile(output)
+	if err != nil {
+		return nil, fmt.Errorf("creating output: %w", err)
+	}
+	defer os.Remove(partial)
+
+	opts.emitPlan(plan)
+	res, err := encode(ctx, opts, plan, plan.Passes, workDir, partial)
+	if err != nil {
+		return nil, err
+	}
+	res.Info, res.Output, res.Action = info, output, ActionEncode
+	if err := opts.finish(ctx, res, partial); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
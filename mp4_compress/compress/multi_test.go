@@ -0,0 +1,65 @@
+package compress
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"phergul/mp4_compress/compress/compresstest"
+)
+
+func TestCompressTargets(t *testing.T) {
+	runner, input := compresstest.New(t, compresstest.Script{Duration: "60", Size: 50 << 20, OutputKB: 1})
+	dir := filepath.Dir(input)
+	// The two large targets keep the full 1280x720 and the two small ones
+	// are scaled down to the same size, so they make two groups.
+	var targets []Target
+	for _, mb := range []float64{20, 10, 1, 0.5} {
+		targets = append(targets, Target{TargetMB: mb, Output: filepath.Join(dir, fmt.Sprintf("out%g.mp4", mb))})
+	}
+	opts := Options{Input: input, Runner: runner, TempDir: t.TempDir()}
+	results, err := CompressTargets(context.Background(), opts, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, jr := range results {
+		if jr.Err != nil {
+			t.Fatalf("%s: %v", targets[i].Output, jr.Err)
+		}
+		if _, err := os.Stat(targets[i].Output); err != nil {
+			t.Errorf("output: %v", err)
+		}
+	}
+
+	// Every pass 2 follows the pass 1 with the same filter.
+	var pass1, pass2 []string
+	filter := func(command string) string {
+		if _, after, ok := strings.Cut(command, " -vf "); ok {
+			return strings.Fields(after)[0]
+		}
+		return ""
+	}
+	last := ""
+	for _, command := range runner.Commands(t) {
+		switch {
+		case strings.Contains(command, "-pass 1"):
+			last = filter(command)
+			pass1 = append(pass1, last)
+		case strings.Contains(command, "-pass 2"):
+			if got := filter(command); got != last {
+				t.Errorf("pass 2 with filter %q follows pass 1 with %q", got, last)
+			}
+			pass2 = append(pass2, filter(command))
+		}
+	}
+	if want := []string{"", "scale=426:240"}; !slices.Equal(pass1, want) {
+		t.Errorf("ran pass 1 with filters %q, want once with each of %q", pass1, want)
+	}
+	if want := []string{"", "", "scale=426:240", "scale=426:240"}; !slices.Equal(pass2, want) {
+		t.Errorf("ran pass 2 with filters %q, want %q", pass2, want)
+	}
+}
@@ -0,0 +1,235 @@
+package compress
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MediaInfo is what Probe learns about an input file.
+type MediaInfo struct {
+	Path      string           `json:"path"`
+	Container string           `json:"container"`
+	Duration  float64          `json:"duration"`          // seconds
+	Size      int64            `json:"size,omitempty"`    // bytes
+	Bitrate   float64          `json:"bitrate,omitempty"` // kbps, whole file
+	Video     []VideoStream    `json:"video"`
+	Audio     []AudioStream    `json:"audio"`
+	Subtitles []SubtitleStream `json:"subtitles"`
+}
+
+// VideoStream describes one video stream of the input.
+type VideoStream struct {
+	Index    int     `json:"index"`
+	Codec    string  `json:"codec"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	FPS      float64 `json:"fps,omitempty"`
+	Rotation int     `json:"rotation,omitempty"` // degrees, as reported by the display matrix
+	Bitrate  float64 `json:"bitrate,omitempty"`  // kbps, 0 if unknown
+}
+
+// AudioStream describes one audio stream of the input.
+type AudioStream struct {
+	Index      int     `json:"index"`
+	Codec      string  `json:"codec"`
+	Channels   int     `json:"channels"`
+	SampleRate int     `json:"sample_rate"`
+	Bitrate    float64 `json:"bitrate,omitempty"` // kbps, 0 if unknown
+	Language   string  `json:"language,omitempty"`
+}
+
+// SubtitleStream describes one subtitle stream of the input.
+type SubtitleStream struct {
+	Index    int    `json:"index"`
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+}
+
+// HasVideo reports whether the input has at least one video stream.
+func (m *MediaInfo) HasVideo() bool {
+	return len(m.Video) > 0
+}
+
+// HasAudio reports whether the input has at least one audio stream.
+func (m *MediaInfo) HasAudio() bool {
+	return len(m.Audio) > 0
+}
+
+// ffprobeOutput mirrors the parts of `ffprobe -print_format json` we read.
+// ffprobe reports most numbers as strings, and "N/A" when it does not know.
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		Size       string            `json:"size"`
+		BitRate    string            `json:"bit_rate"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		Index        int               `json:"index"`
+		CodecType    string            `json:"codec_type"`
+		CodecName    string            `json:"codec_name"`
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		AvgFrameRate string            `json:"avg_frame_rate"`
+		RFrameRate   string            `json:"r_frame_rate"`
+		Channels     int               `json:"channels"`
+		SampleRate   string            `json:"sample_rate"`
+		BitRate      string            `json:"bit_rate"`
+		Duration     string            `json:"duration"`
+		Tags         map[string]string `json:"tags"`
+		SideDataList []struct {
+			Rotation *float64 `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+}
+
+// Probe reads the container and stream details of path with ffprobe, run by
+// runner, or from the PATH if runner is nil.
+func Probe(ctx context.Context, runner Runner, path string) (*MediaInfo, error) {
+	cmd := orExec(runner).Command(ctx, "ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path,
+	)
+	var out bytes.Buffer
+	stderr := newRingBuffer(stderrTail)
+	cmd.Stdout = &out
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, &ProbeError{Path: path, Err: ctx.Err()}
+		}
+		return nil, &ProbeError{Path: path, Err: classifyFailure("ffprobe", cmd.Path, err, stderr.Bytes())}
+	}
+
+	info, err := parseProbe(path, out.Bytes())
+	if err != nil {
+		return nil, &ProbeError{Path: path, Err: err}
+	}
+	return info, nil
+}
+
+// parseProbe builds a MediaInfo from ffprobe's JSON output.
+func parseProbe(path string, data []byte) (*MediaInfo, error) {
+	var raw ffprobeOutput
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid ffprobe output: %v", err)
+	}
+
+	info := &MediaInfo{
+		Path:      path,
+		Container: raw.Format.FormatName,
+		Duration:  parseNumber(raw.Format.Duration),
+		Size:      int64(parseNumber(raw.Format.Size)),
+		Bitrate:   parseNumber(raw.Format.BitRate) / 1000,
+		Video:     []VideoStream{},
+		Audio:     []AudioStream{},
+		Subtitles: []SubtitleStream{},
+	}
+
+	// Some containers (MKV, WebM, raw streams) only know the duration per
+	// stream, or only in a DURATION tag.
+	if info.Duration <= 0 {
+		info.Duration = parseTagDuration(raw.Format.Tags)
+	}
+	streamDuration := 0.0
+
+	for _, s := range raw.Streams {
+		streamDuration = math.Max(streamDuration, math.Max(parseNumber(s.Duration), parseTagDuration(s.Tags)))
+
+		switch s.CodecType {
+		case "video":
+			v := VideoStream{
+				Index:   s.Index,
+				Codec:   s.CodecName,
+				Width:   s.Width,
+				Height:  s.Height,
+				FPS:     parseRate(s.AvgFrameRate),
+				Bitrate: parseNumber(s.BitRate) / 1000,
+			}
+			if v.FPS == 0 {
+				v.FPS = parseRate(s.RFrameRate)
+			}
+			for _, sd := range s.SideDataList {
+				if sd.Rotation != nil {
+					v.Rotation = int(math.Round(*sd.Rotation))
+				}
+			}
+			if v.Rotation == 0 {
+				v.Rotation, _ = strconv.Atoi(s.Tags["rotate"])
+			}
+			info.Video = append(info.Video, v)
+		case "audio":
+			info.Audio = append(info.Audio, AudioStream{
+				Index:      s.Index,
+				Codec:      s.CodecName,
+				Channels:   s.Channels,
+				SampleRate: int(parseNumber(s.SampleRate)),
+				Bitrate:    parseNumber(s.BitRate) / 1000,
+				Language:   s.Tags["language"],
+			})
+		case "subtitle":
+			info.Subtitles = append(info.Subtitles, SubtitleStream{
+				Index:    s.Index,
+				Codec:    s.CodecName,
+				Language: s.Tags["language"],
+			})
+		}
+	}
+
+	if info.Duration <= 0 {
+		info.Duration = streamDuration
+	}
+	if info.Duration <= 0 {
+		return nil, errors.New("unknown duration")
+	}
+	if info.Bitrate == 0 && info.Size > 0 {
+		info.Bitrate = float64(info.Size) * 8 / 1000 / info.Duration
+	}
+	return info, nil
+}
+
+// parseNumber parses one of ffprobe's numeric strings, returning 0 for "N/A"
+// and anything else it cannot read.
+func parseNumber(s string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+		return 0
+	}
+	return v
+}
+
+// parseRate parses frame rates such as "30000/1001".
+func parseRate(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		return parseNumber(s)
+	}
+	n, d := parseNumber(num), parseNumber(den)
+	if d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// parseTagDuration reads the DURATION tag Matroska muxers write, e.g.
+// "00:01:02.345000000".
+func parseTagDuration(tags map[string]string) float64 {
+	for key, value := range tags {
+		if strings.EqualFold(key, "duration") {
+			if v, err := ParseTimestamp(value); err == nil {
+				return v
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package compress
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProbe(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		duration float64
+		bitrate  float64
+		err      string
+	}{
+		{
+			name:     "format duration",
+			json:     `{"format": {"duration": "20.5", "size": "5000000", "bit_rate": "1951219"}}`,
+			duration: 20.5,
+			bitrate:  1951.219,
+		},
+		{
+			name:     "bitrate from size when N/A",
+			json:     `{"format": {"duration": "10", "size": "1250000", "bit_rate": "N/A"}}`,
+			duration: 10,
+			bitrate:  1000,
+		},
+		{
+			name:     "stream duration when the format has none",
+			json:     `{"format": {"duration": "N/A"}, "streams": [{"codec_type": "video", "duration": "12.5"}, {"codec_type": "audio", "duration": "12.7"}]}`,
+			duration: 12.7,
+		},
+		{
+			name:     "Matroska DURATION tag",
+			json:     `{"format": {"tags": {"DURATION": "00:01:02.500000000"}}}`,
+			duration: 62.5,
+		},
+		{name: "N/A everywhere", json: `{"format": {"duration": "N/A"}, "streams": [{"codec_type": "video", "duration": "N/A"}]}`, err: "unknown duration"},
+		{name: "zero duration", json: `{"format": {"duration": "0"}}`, err: "unknown duration"},
+		{name: "negative duration", json: `{"format": {"duration": "-3"}}`, err: "unknown duration"},
+		{name: "not JSON", json: `Invalid data found when processing input`, err: "invalid ffprobe output"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := parseProbe("in.mkv", []byte(tt.json))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseProbe() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseProbe() error = %v", err)
+			}
+			if !near(info.Duration, tt.duration) || !near(info.Bitrate, tt.bitrate) {
+				t.Errorf("parseProbe() = %v sec, %v kbps; want %v sec, %v kbps", info.Duration, info.Bitrate, tt.duration, tt.bitrate)
+			}
+		})
+	}
+}
+
+func TestParseProbeStreams(t *testing.T) {
+	info, err := parseProbe("in.mp4", []byte(`{
+		"format": {"duration": "5"},
+		"streams": [
+			{"index": 0, "codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080,
+			 "avg_frame_rate": "0/0", "r_frame_rate": "30000/1001", "side_data_list": [{"rotation": -90}]},
+			{"index": 1, "codec_type": "audio", "codec_name": "aac", "channels": 6, "sample_rate": "48000",
+			 "bit_rate": "384000", "tags": {"language": "eng"}},
+			{"index": 2, "codec_type": "subtitle", "codec_name": "mov_text"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Video) != 1 || len(info.Audio) != 1 || len(info.Subtitles) != 1 {
+		t.Fatalf("got %d video, %d audio, %d subtitle streams", len(info.Video), len(info.Audio), len(info.Subtitles))
+	}
+	v, a := info.Video[0], info.Audio[0]
+	if v.Width != 1920 || v.Height != 1080 || !near(v.FPS, 30000/1001.0) || v.Rotation != -90 {
+		t.Errorf("video = %+v", v)
+	}
+	if a.Channels != 6 || a.SampleRate != 48000 || a.Bitrate != 384 || a.Language != "eng" {
+		t.Errorf("audio = %+v", a)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package compress
+
+import "os/exec"
+
+// setProcessGroup kills ffmpeg directly on cancellation; there are no
+// process groups to signal on this platform.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.Cancel = func() error {
+		return cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package compress
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in its own process group and makes cancellation
+// signal the whole group, so helpers ffmpeg spawns are stopped too and a
+// terminal Ctrl-C reaches us rather than ffmpeg directly.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+}
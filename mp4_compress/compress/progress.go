@@ -0,0 +1,75 @@
+package compress
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is a snapshot of a running pass, taken from ffmpeg's -progress
+// output.
+type Progress struct {
+	Pass     int
+	Passes   int
+	OutTime  float64 // seconds of output encoded so far
+	Duration float64 // seconds of output the pass will encode
+	Speed    float64 // encoding speed relative to realtime, 0 if unknown
+}
+
+// Fraction is how far the current pass is, between 0 and 1.
+func (p Progress) Fraction() float64 {
+	if p.Duration <= 0 {
+		return 0
+	}
+	return math.Min(math.Max(p.OutTime/p.Duration, 0), 1)
+}
+
+// TotalFraction is how far the whole encode is across all passes.
+func (p Progress) TotalFraction() float64 {
+	if p.Passes <= 0 {
+		return p.Fraction()
+	}
+	return (float64(p.Pass-1) + p.Fraction()) / float64(p.Passes)
+}
+
+// ETA estimates the time left for the remaining passes, assuming they run at
+// the current speed. ok is false until ffmpeg has reported a speed.
+func (p Progress) ETA() (eta time.Duration, ok bool) {
+	if p.Speed <= 0 {
+		return 0, false
+	}
+	remaining := p.Duration*(1-p.Fraction()) + p.Duration*float64(p.Passes-p.Pass)
+	return time.Duration(remaining / p.Speed * float64(time.Second)), true
+}
+
+// readProgress parses the key=value blocks ffmpeg writes with -progress and
+// calls report at the end of every block.
+func readProgress(r io.Reader, p Progress, report func(Progress)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "out_time_us":
+			if us, err := strconv.ParseFloat(value, 64); err == nil {
+				p.OutTime = us / 1e6
+			}
+		case "out_time":
+			if p.OutTime == 0 {
+				if t, err := ParseTimestamp(value); err == nil {
+					p.OutTime = t
+				}
+			}
+		case "speed":
+			p.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "x"), 64)
+		case "progress":
+			report(p)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package compress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Quality holds the scores of an output compared with the part of the input
+// it was encoded from.
+type Quality struct {
+	SSIM float64 // all planes, 1 for identical frames
+	PSNR float64 // average over all planes in dB, +Inf for identical frames
+}
+
+// HasPSNR reports whether PSNR is finite, which it is not when the output is
+// identical to the input.
+func (q *Quality) HasPSNR() bool {
+	return !math.IsInf(q.PSNR, 0)
+}
+
+var (
+	ssimPattern = regexp.MustCompile(`SSIM .*All:([0-9.]+|inf)`)
+	psnrPattern = regexp.MustCompile(`PSNR .*average:([0-9.]+|inf)`)
+)
+
+// Measure compares the video of res.Output with the range of input it was
+// encoded from, using ffmpeg's ssim and psnr filters. An output that was
+// scaled or had its frame rate lowered is compared at the source resolution
+// against the source resampled to the output frame rate. A nil runner runs
+// ffmpeg from the PATH.
+func Measure(ctx context.Context, runner Runner, input string, res *Result) (*Quality, error) {
+	cmd := orExec(runner).Command(ctx, "ffmpeg", measureArgs(input, res)...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = killDelay
+	// The summary lines come last, so the tail of stderr holds them.
+	stderr := newRingBuffer(stderrTail)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, classifyFailure("ffmpeg", cmd.Path, err, stderr.Bytes())
+	}
+	return parseQuality(stderr.Bytes())
+}
+
+// measureArgs builds the ffmpeg arguments for Measure. The output is input 0
+// and the reference input 1, as the ssim and psnr filters expect.
+func measureArgs(input string, res *Result) []string {
+	plan := res.Plan
+	args := []string{"-hide_banner", "-nostats", "-i", res.Output}
+	if plan.Trimmed {
+		args = append(args, "-ss", formatSeconds(plan.Start), "-t", formatSeconds(plan.Duration))
+	}
+	args = append(args, "-i", input)
+
+	var distorted, reference []string
+	if plan.Width > 0 && res.Info != nil && len(res.Info.Video) > 0 {
+		w, h := displaySize(res.Info.Video[0])
+		distorted = append(distorted, fmt.Sprintf("scale=%d:%d:flags=bicubic", w, h))
+	}
+	if plan.FPS > 0 {
+		reference = append(reference, "fps="+formatRate(plan.FPS))
+	}
+	// Both streams start from zero so frames are paired by position rather
+	// than by the timestamps of the source.
+	distorted = append(distorted, "setpts=PTS-STARTPTS", "split[d1][d2]")
+	reference = append(reference, "setpts=PTS-STARTPTS", "split[r1][r2]")
+	graph := "[0:v:0]" + strings.Join(distorted, ",") + ";" +
+		"[1:v:0]" + strings.Join(reference, ",") + ";" +
+		"[d1][r1]ssim;[d2][r2]psnr"
+
+	return append(args, "-lavfi", graph, "-an", "-f", "null", "-")
+}
+
+// parseQuality reads the summary lines the ssim and psnr filters log when
+// they finish.
+func parseQuality(log []byte) (*Quality, error) {
+	ssim := ssimPattern.FindSubmatch(log)
+	psnr := psnrPattern.FindSubmatch(log)
+	if ssim == nil || psnr == nil {
+		return nil, errors.New("no SSIM/PSNR summary in ffmpeg output")
+	}
+	q := &Quality{}
+	var err error
+	if q.SSIM, err = strconv.ParseFloat(string(ssim[1]), 64); err != nil {
+		return nil, fmt.Errorf("invalid SSIM %q", ssim[1])
+	}
+	if q.PSNR, err = strconv.ParseFloat(string(psnr[1]), 64); err != nil {
+		return nil, fmt.Errorf("invalid PSNR %q", psnr[1])
+	}
+	return q, nil
+}
+
+// displaySize is the size of video as ffmpeg shows it, after rotation.
+func displaySize(video VideoStream) (width, height int) {
+	if video.Rotation%180 != 0 {
+		return video.Height, video.Width
+	}
+	return video.Width, video.Height
+}
@@ -0,0 +1,94 @@
+package compress
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// pass1StampName is the file, next to the pass logs in Options.WorkDir,
+// that records the pass 1 they came from.
+const pass1StampName = "pass1.json"
+
+// pass1Stamp identifies a finished pass 1: its ffmpeg arguments, which hold
+// the input, range, bitrate, filters and encoder settings, and the input
+// file as it was then.
+type pass1Stamp struct {
+	Args    []string  `json:"args"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// jobDir returns the directory for the pass logs of a job and a function
+// that removes it afterwards, unless it is opts.WorkDir.
+func (opts Options) jobDir() (string, func(), error) {
+	if opts.WorkDir != "" {
+		if err := os.MkdirAll(opts.WorkDir, 0755); err != nil {
+			return "", nil, fmt.Errorf("creating pass log directory: %w", err)
+		}
+		return opts.WorkDir, func() {}, nil
+	}
+	dir, err := os.MkdirTemp(opts.TempDir, "mp4_compress-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("creating pass log directory: %w", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }, nil
+}
+
+// firstPass returns the pass to start plan from: 2 if opts.WorkDir holds the
+// stats of the same pass 1 from an earlier run, and 1 otherwise.
+func (opts Options) firstPass(plan Plan) int {
+	if opts.WorkDir == "" || plan.Passes < Passes {
+		return 1
+	}
+	want, ok := newPass1Stamp(opts, plan)
+	if !ok {
+		return 1
+	}
+	data, err := os.ReadFile(filepath.Join(opts.WorkDir, pass1StampName))
+	if err != nil {
+		return 1
+	}
+	var have pass1Stamp
+	if json.Unmarshal(data, &have) != nil || !slices.Equal(have.Args, want.Args) ||
+		have.Size != want.Size || !have.ModTime.Equal(want.ModTime) {
+		return 1
+	}
+	opts.emit(Event{Kind: EventPassSkip, Pass: 1, Passes: plan.Passes})
+	return 2
+}
+
+func newPass1Stamp(opts Options, plan Plan) (pass1Stamp, bool) {
+	stat, err := os.Stat(opts.Input)
+	if err != nil {
+		return pass1Stamp{}, false
+	}
+	return pass1Stamp{Args: passArgs(opts, plan, 1, ""), Size: stat.Size(), ModTime: stat.ModTime()}, true
+}
+
+// clearPass1 removes the stamp in opts.WorkDir before pass 1 runs, so stats
+// from an unfinished pass are never reused.
+func (opts Options) clearPass1() {
+	if opts.WorkDir != "" {
+		os.Remove(filepath.Join(opts.WorkDir, pass1StampName))
+	}
+}
+
+// markPass1 records in opts.WorkDir that pass 1 of plan finished.
+func (opts Options) markPass1(plan Plan) error {
+	if opts.WorkDir == "" || plan.Passes < Passes {
+		return nil
+	}
+	stamp, ok := newPass1Stamp(opts, plan)
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(stamp)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(opts.WorkDir, pass1StampName), data, 0644)
+}
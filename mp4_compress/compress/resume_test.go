@@ -0,0 +1,103 @@
+package compress
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"phergul/mp4_compress/compress/compresstest"
+)
+
+func TestResume(t *testing.T) {
+	script := compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 1024}
+	tests := []struct {
+		name   string
+		change func(t *testing.T, input string, opts *Options)
+		passes []int // the passes the resumed job runs
+	}{
+		{name: "unchanged job skips pass 1", passes: []int{2}},
+		{
+			name: "changed input size",
+			change: func(t *testing.T, input string, opts *Options) {
+				if err := os.WriteFile(input, []byte("a longer stand-in for a video"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			passes: []int{1, 2},
+		},
+		{
+			name: "changed input time",
+			change: func(t *testing.T, input string, opts *Options) {
+				later := time.Now().Add(time.Hour)
+				if err := os.Chtimes(input, later, later); err != nil {
+					t.Fatal(err)
+				}
+			},
+			passes: []int{1, 2},
+		},
+		{
+			name:   "changed bitrate",
+			change: func(t *testing.T, input string, opts *Options) { opts.TargetMB = 3 },
+			passes: []int{1, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, input := compresstest.New(t, script)
+			opts := Options{
+				Input:    input,
+				Output:   filepath.Join(filepath.Dir(input), "output.mp4"),
+				TargetMB: 2,
+				Force:    true,
+				WorkDir:  filepath.Join(t.TempDir(), "work"),
+			}
+
+			// The first run stops in pass 2, leaving the stats of pass 1.
+			failing := runner
+			failing.Script.FailPass = 2
+			opts.Runner = failing
+			if _, err := Compress(context.Background(), opts); err == nil {
+				t.Fatal("Compress() succeeded, want pass 2 to fail")
+			}
+			if _, err := os.Stat(filepath.Join(opts.WorkDir, pass1StampName)); err != nil {
+				t.Fatalf("pass 1 was not recorded: %v", err)
+			}
+			before := len(runner.Commands(t))
+
+			if tt.change != nil {
+				tt.change(t, input, &opts)
+			}
+			var skipped bool
+			opts.Runner = runner
+			opts.OnEvent = func(e Event) {
+				if e.Kind == EventPassSkip {
+					skipped = true
+				}
+			}
+			if _, err := Compress(context.Background(), opts); err != nil {
+				t.Fatal(err)
+			}
+
+			var passes []int
+			for _, command := range runner.Commands(t)[before:] {
+				switch {
+				case strings.Contains(command, "-pass 1"):
+					passes = append(passes, 1)
+				case strings.Contains(command, "-pass 2"):
+					passes = append(passes, 2)
+				}
+			}
+			if !slices.Equal(passes, tt.passes) {
+				t.Errorf("resumed job ran passes %v, want %v", passes, tt.passes)
+			}
+			if want := tt.passes[0] == 2; skipped != want {
+				t.Errorf("pass_skip emitted = %v, want %v", skipped, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package compress
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Runner creates the ffmpeg and ffprobe commands the package runs, so they
+// can come from somewhere other than the PATH, such as a fake in tests.
+type Runner interface {
+	// Command returns a command that runs name, "ffmpeg" or "ffprobe",
+	// with args. The caller sets up its I/O, cancellation and directory.
+	Command(ctx context.Context, name string, args ...string) *exec.Cmd
+}
+
+// ExecRunner runs the ffmpeg and ffprobe binaries at FFmpeg and FFprobe, or
+// the ones on the PATH where those are empty.
+type ExecRunner struct {
+	FFmpeg  string
+	FFprobe string
+}
+
+func (r ExecRunner) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	switch {
+	case name == "ffmpeg" && r.FFmpeg != "":
+		name = r.FFmpeg
+	case name == "ffprobe" && r.FFprobe != "":
+		name = r.FFprobe
+	}
+	return exec.CommandContext(ctx, name, args...)
+}
+
+// runner returns opts.Runner, or an ExecRunner if it is not set.
+func (opts Options) runner() Runner {
+	return orExec(opts.Runner)
+}
+
+// orExec returns runner, or an ExecRunner if runner is nil.
+func orExec(runner Runner) Runner {
+	if runner != nil {
+		return runner
+	}
+	return ExecRunner{}
+}
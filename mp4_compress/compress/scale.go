@@ -0,0 +1,103 @@
+package compress
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// minBitsPerPixel is the lowest bits per pixel per frame the automatic
+	// scaling lets x264 work with before it lowers the frame rate and then
+	// the resolution.
+	minBitsPerPixel = 0.04
+	// autoScaleFPS is the frame rate high frame rate inputs are dropped to
+	// first when the bitrate is too low for them.
+	autoScaleFPS = 30.0
+	// minShortSide is the smallest height (or width, for portrait video) the
+	// automatic scaling goes down to.
+	minShortSide = 240
+)
+
+// planScale picks the output resolution and frame rate for a video stream
+// encoded at videoKbps. The Max* options always apply; unless NoAutoScale is
+// set, the frame rate and then the resolution are lowered further until
+// every pixel gets at least minBitsPerPixel, scaled by the codec's
+// efficiency. It returns zeros for whatever stays as in the source.
+func planScale(opts Options, video VideoStream, videoKbps, efficiency float64) (width, height int, fps float64) {
+	w, h := float64(video.Width), float64(video.Height)
+	if video.Rotation%180 != 0 {
+		// ffmpeg rotates before filtering, so limits apply to the displayed
+		// orientation.
+		w, h = h, w
+	}
+	if w <= 0 || h <= 0 {
+		return 0, 0, 0
+	}
+	sourceW, sourceH, sourceFPS := w, h, video.FPS
+
+	fps = video.FPS
+	if opts.MaxFPS > 0 && (fps == 0 || fps > opts.MaxFPS) {
+		fps = opts.MaxFPS
+	}
+	scale := 1.0
+	if opts.MaxWidth > 0 {
+		scale = math.Min(scale, float64(opts.MaxWidth)/w)
+	}
+	if opts.MaxHeight > 0 {
+		scale = math.Min(scale, float64(opts.MaxHeight)/h)
+	}
+
+	if !opts.NoAutoScale && fps > 0 {
+		minBPP := minBitsPerPixel * efficiency
+		bpp := func() float64 {
+			return videoKbps * 1000 / (w * scale * h * scale * fps)
+		}
+		if bpp() < minBPP && fps > autoScaleFPS {
+			fps = autoScaleFPS
+		}
+		if bpp() < minBPP {
+			wanted := math.Sqrt(videoKbps * 1000 / (fps * minBPP) / (w * h))
+			floor := math.Min(1, minShortSide/math.Min(w, h))
+			scale = math.Min(scale, math.Max(wanted, floor))
+		}
+	}
+
+	if scale < 1 {
+		width, height = evenRound(sourceW*scale), evenRound(sourceH*scale)
+		// Rounding to an even size must not go over an odd limit.
+		if opts.MaxWidth > 0 && width > opts.MaxWidth {
+			width = max(2, width-2)
+		}
+		if opts.MaxHeight > 0 && height > opts.MaxHeight {
+			height = max(2, height-2)
+		}
+	}
+	if fps == sourceFPS {
+		fps = 0
+	}
+	return width, height, fps
+}
+
+// evenRound rounds v to the nearest even number, as x264 needs even frame
+// dimensions for 4:2:0 video.
+func evenRound(v float64) int {
+	return max(2, int(math.Round(v/2))*2)
+}
+
+// videoFilter returns the -vf filter chain for the scaling in plan, or "" if
+// the video is encoded as is.
+func videoFilter(plan Plan) string {
+	var filters []string
+	if plan.Width > 0 {
+		filters = append(filters, fmt.Sprintf("scale=%d:%d", plan.Width, plan.Height))
+	}
+	if plan.FPS > 0 {
+		filters = append(filters, "fps="+formatRate(plan.FPS))
+	}
+	return strings.Join(filters, ",")
+}
+
+func formatRate(fps float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", fps), "0"), ".")
+}
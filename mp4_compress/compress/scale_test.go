@@ -0,0 +1,63 @@
+package compress
+
+import "testing"
+
+func TestPlanScale(t *testing.T) {
+	hd := VideoStream{Width: 1920, Height: 1080, FPS: 30}
+	tests := []struct {
+		name       string
+		opts       Options
+		video      VideoStream
+		videoKbps  float64
+		efficiency float64
+		width      int
+		height     int
+		fps        float64
+	}{
+		{name: "enough bits per pixel", video: hd, videoKbps: 8000, efficiency: 1},
+		{name: "too few bits per pixel", video: hd, videoKbps: 1000, efficiency: 1, width: 1218, height: 684},
+		{name: "efficient codec needs fewer bits", video: hd, videoKbps: 1500, efficiency: 0.5},
+		{name: "less efficient codec at the same bitrate", video: hd, videoKbps: 1500, efficiency: 1, width: 1490, height: 838},
+		{name: "scaling stops at the shortest side", video: hd, videoKbps: 100, efficiency: 1, width: 426, height: 240},
+		{name: "high frame rate drops first", video: VideoStream{Width: 1280, Height: 720, FPS: 60}, videoKbps: 1500, efficiency: 1, fps: 30},
+		{name: "no auto scale keeps everything", opts: Options{NoAutoScale: true}, video: hd, videoKbps: 100, efficiency: 1},
+		{name: "max width", opts: Options{MaxWidth: 1280, NoAutoScale: true}, video: hd, width: 1280, height: 720},
+		{name: "max height above the source", opts: Options{MaxHeight: 2160, NoAutoScale: true}, video: hd},
+		{
+			name:  "rotated source is limited as displayed",
+			opts:  Options{MaxWidth: 720, NoAutoScale: true},
+			video: VideoStream{Width: 1920, Height: 1080, FPS: 30, Rotation: 90},
+			width: 720, height: 1280,
+		},
+		{
+			name:  "upside down source is not rotated",
+			opts:  Options{MaxWidth: 720, NoAutoScale: true},
+			video: VideoStream{Width: 1920, Height: 1080, FPS: 30, Rotation: 180},
+			width: 720, height: 406,
+		},
+		{
+			name:  "making a size even does not break its limit",
+			opts:  Options{MaxWidth: 1001, NoAutoScale: true},
+			video: hd,
+			width: 1000, height: 564,
+		},
+		{
+			name:  "odd limit on the other side",
+			opts:  Options{MaxHeight: 563, NoAutoScale: true},
+			video: hd,
+			width: 1000, height: 562,
+		},
+		{name: "max fps", opts: Options{MaxFPS: 24, NoAutoScale: true}, video: hd, fps: 24},
+		{name: "max fps above the source", opts: Options{MaxFPS: 60, NoAutoScale: true}, video: hd},
+		{name: "max fps with an unknown source rate", opts: Options{MaxFPS: 24, NoAutoScale: true}, video: VideoStream{Width: 1920, Height: 1080}, fps: 24},
+		{name: "unknown size", video: VideoStream{FPS: 30}, videoKbps: 100, efficiency: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, fps := planScale(tt.opts, tt.video, tt.videoKbps, tt.efficiency)
+			if width != tt.width || height != tt.height || fps != tt.fps {
+				t.Errorf("planScale() = %dx%d at %g fps, want %dx%d at %g fps", width, height, fps, tt.width, tt.height, tt.fps)
+			}
+		})
+	}
+}
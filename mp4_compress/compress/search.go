@@ -0,0 +1,149 @@
+package compress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// searchSamples is how many segments of the input FindCRF encodes for
+	// each CRF it tries, and searchSampleLength their length in seconds.
+	searchSamples      = 3
+	searchSampleLength = 4.0
+	// searchLow and searchHigh bound the searched CRFs as fractions of the
+	// codec's highest CRF; outside them the search gains nothing useful.
+	searchLow  = 0.2
+	searchHigh = 0.8
+)
+
+// ErrInvalidQuality is wrapped by errors about Options.MinSSIM.
+var ErrInvalidQuality = errors.New("invalid quality target")
+
+// SearchStep is one CRF tried by FindCRF, with the results of its samples.
+type SearchStep struct {
+	CRF         float64
+	SSIM        float64 // mean over the samples
+	EstimatedMB float64 // size of the whole output extrapolated from the samples
+}
+
+// FindCRF looks for the highest CRF, and so the smallest output, whose
+// encode of a few short samples of opts.Input still reaches opts.MinSSIM. It
+// binary-searches whole CRF values and reports every step as an
+// EventSearch. met is false when even the lowest CRF searched falls short,
+// in which case that CRF is returned.
+func FindCRF(ctx context.Context, opts Options, info *MediaInfo) (best SearchStep, met bool, err error) {
+	defer func() { opts.logFailure(err) }()
+	if opts.MinSSIM <= 0 || opts.MinSSIM >= 1 || math.IsNaN(opts.MinSSIM) {
+		return SearchStep{}, false, fmt.Errorf("%w: SSIM must be between 0 and 1", ErrInvalidQuality)
+	}
+	if !info.HasVideo() {
+		return SearchStep{}, false, fmt.Errorf("%w in %s", ErrNoVideo, opts.Input)
+	}
+	codec := opts.Codec.orDefault()
+	if err := checkCodecOptions(opts, codec); err != nil {
+		return SearchStep{}, false, err
+	}
+	start, end, err := opts.Range(info.Duration)
+	if err != nil {
+		return SearchStep{}, false, err
+	}
+	audio, _, err := planAudio(opts, info, math.Inf(1))
+	if err != nil {
+		return SearchStep{}, false, err
+	}
+
+	workDir, err := os.MkdirTemp(opts.TempDir, "mp4_compress-*")
+	if err != nil {
+		return SearchStep{}, false, fmt.Errorf("creating sample directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+	if opts.Input, err = absPath(opts.Input); err != nil {
+		return SearchStep{}, false, err
+	}
+
+	// The samples share the scaling of the full encode but no audio; the
+	// planned audio bitrate is added to the estimate instead.
+	sample := Plan{Codec: codec, Trimmed: true, Passes: 1}
+	scaleOpts := opts
+	scaleOpts.NoAutoScale = true
+	sample.Width, sample.Height, sample.FPS = planScale(scaleOpts, info.Video[0], 0, codecs[codec].efficiency)
+	audioKbps := 0.0
+	for _, track := range audio {
+		audioKbps += track.Kbps
+	}
+	ranges := sampleRanges(start, end)
+
+	try := func(crf float64) (SearchStep, error) {
+		step := SearchStep{CRF: crf}
+		sampleOpts := opts
+		sampleOpts.OnEvent = nil
+		var bytes int64
+		var seconds float64
+		for i, r := range ranges {
+			plan := sample
+			plan.CRF = crf
+			plan.Start, plan.End, plan.Duration = r[0], r[1], r[1]-r[0]
+			output := filepath.Join(workDir, fmt.Sprintf("sample%d%s", i, codec.Ext()))
+			if err := runPass(ctx, sampleOpts, plan, 1, workDir, output); err != nil {
+				return step, err
+			}
+			stat, err := os.Stat(output)
+			if err != nil {
+				return step, err
+			}
+			q, err := Measure(ctx, opts.runner(), opts.Input, &Result{Info: info, Plan: plan, Output: output})
+			if err != nil {
+				return step, err
+			}
+			bytes += stat.Size()
+			seconds += plan.Duration
+			step.SSIM += q.SSIM / float64(len(ranges))
+		}
+		videoKbps := float64(bytes) * 8 / 1024 / seconds
+		step.EstimatedMB = (videoKbps + audioKbps) * (end - start) / 8192
+		opts.emit(Event{Kind: EventSearch, Step: &step})
+		return step, nil
+	}
+
+	maxCRF := codecs[codec].maxCRF
+	low, high := math.Round(maxCRF*searchLow), math.Round(maxCRF*searchHigh)
+	for low <= high {
+		crf := math.Floor((low + high) / 2)
+		step, err := try(crf)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return SearchStep{}, false, fmt.Errorf("encoding samples at CRF %g: %w", crf, err)
+		}
+		if step.SSIM >= opts.MinSSIM {
+			best, met = step, true
+			low = crf + 1
+		} else {
+			if !met {
+				best = step
+			}
+			high = crf - 1
+		}
+	}
+	return best, met, nil
+}
+
+// sampleRanges spreads searchSamples segments evenly over start to end, or
+// returns the whole range when it is too short to sample.
+func sampleRanges(start, end float64) [][2]float64 {
+	duration := end - start
+	if duration <= searchSamples*searchSampleLength {
+		return [][2]float64{{start, end}}
+	}
+	ranges := make([][2]float64, searchSamples)
+	for i := range ranges {
+		middle := start + duration*(float64(i)+0.5)/searchSamples
+		ranges[i] = [2]float64{middle - searchSampleLength/2, middle + searchSampleLength/2}
+	}
+	return ranges
+}
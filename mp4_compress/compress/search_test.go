@@ -0,0 +1,135 @@
+package compress
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"phergul/mp4_compress/compress/compresstest"
+)
+
+func TestFindCRF(t *testing.T) {
+	// The SSIM drops by 0.01 per CRF, and libx264's searched CRFs run from
+	// 10 to 41.
+	tests := []struct {
+		name    string
+		minSSIM float64
+		crf     float64
+		met     bool
+	}{
+		{name: "threshold inside the range", minSSIM: 0.745, crf: 25, met: true},
+		{name: "threshold met everywhere", minSSIM: 0.5, crf: 41, met: true},
+		{name: "threshold met nowhere", minSSIM: 0.95, crf: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, input := compresstest.New(t, compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 1, SSIMPerCRF: 0.01})
+			info, err := Probe(context.Background(), runner, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var steps []float64
+			opts := Options{Input: input, MinSSIM: tt.minSSIM, Runner: runner, TempDir: t.TempDir()}
+			opts.OnEvent = func(e Event) {
+				if e.Kind == EventSearch {
+					steps = append(steps, e.Step.CRF)
+				}
+			}
+
+			best, met, err := FindCRF(context.Background(), opts, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if best.CRF != tt.crf || met != tt.met {
+				t.Errorf("FindCRF() = CRF %g, met %v; want CRF %g, met %v", best.CRF, met, tt.crf, tt.met)
+			}
+			// A binary search of 32 values takes at most 6 steps.
+			if len(steps) == 0 || len(steps) > 6 {
+				t.Errorf("searched %v, want 1 to 6 steps", steps)
+			}
+			for i, crf := range steps {
+				if crf < 10 || crf > 41 || slices.Contains(steps[:i], crf) {
+					t.Errorf("searched %v, want distinct CRFs from 10 to 41", steps)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestCompressMinSSIMLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		sizes   []compresstest.SizeRule
+		crfRuns int // full encodes at the found CRF
+		passes  int // passes of encodes to the limit
+		warning string
+	}{
+		{
+			name:    "estimate within the limit",
+			sizes:   []compresstest.SizeRule{{Arg: "sample", KB: 1}},
+			crfRuns: 1,
+		},
+		{
+			name:    "estimate over the limit",
+			sizes:   []compresstest.SizeRule{{Arg: "-crf", KB: 3000}},
+			passes:  2,
+			warning: "needs about",
+		},
+		{
+			name:    "output over the limit",
+			sizes:   []compresstest.SizeRule{{Arg: "sample", KB: 1}, {Arg: "-crf", KB: 3000}},
+			crfRuns: 1,
+			passes:  2,
+			warning: "output is 2.93 MB, over the 2.00 MB limit",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, input := compresstest.New(t, compresstest.Script{
+				Duration: "20.5", Size: 5 << 20, OutputKB: 1024, OutputIf: tt.sizes, SSIMPerCRF: 0.01,
+			})
+			opts := Options{
+				Input:    input,
+				Output:   filepath.Join(filepath.Dir(input), "output.mp4"),
+				MinSSIM:  0.745,
+				TargetMB: 2,
+				Runner:   runner,
+				TempDir:  t.TempDir(),
+			}
+			var warnings []string
+			opts.OnEvent = func(e Event) {
+				if e.Kind == EventWarning {
+					warnings = append(warnings, e.Message)
+				}
+			}
+
+			res, err := Compress(context.Background(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Size != 1<<20 || res.Search == nil || res.Search.CRF != 25 {
+				t.Errorf("Result = %d bytes, search %+v; want 1 MB after searching CRF 25", res.Size, res.Search)
+			}
+
+			var crfRuns, passes int
+			for _, command := range runner.Commands(t) {
+				switch {
+				case strings.Contains(command, "sample"):
+				case strings.Contains(command, "-crf 25"):
+					crfRuns++
+				case strings.Contains(command, "-pass "):
+					passes++
+				}
+			}
+			if crfRuns != tt.crfRuns || passes != tt.passes {
+				t.Errorf("ran %d CRF encodes and %d passes, want %d and %d", crfRuns, passes, tt.crfRuns, tt.passes)
+			}
+			if got := strings.Join(warnings, "\n"); tt.warning == "" && got != "" || !strings.Contains(got, tt.warning) {
+				t.Errorf("warnings %q, want %q", got, tt.warning)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// keyframeWindow is how far, as a fraction of the part length, SplitParts
+// moves a cut to land it on a keyframe.
+const keyframeWindow = 0.1
+
+// ErrInvalidSplit is wrapped by errors about splitting an input into parts.
+var ErrInvalidSplit = errors.New("invalid split")
+
+// Part is one piece of a split input, in seconds of the input.
+type Part struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// Duration is the length of the part in seconds.
+func (p Part) Duration() float64 {
+	return p.End - p.Start
+}
+
+// Keyframes lists the keyframe times, in seconds, of the first video stream
+// of path. A nil runner runs ffprobe from the PATH.
+func Keyframes(ctx context.Context, runner Runner, path string) ([]float64, error) {
+	cmd := orExec(runner).Command(ctx, "ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-skip_frame", "nokey",
+		"-show_entries", "frame=pts_time",
+		"-of", "csv=p=0",
+		path,
+	)
+	var out bytes.Buffer
+	stderr := newRingBuffer(stderrTail)
+	cmd.Stdout = &out
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, &ProbeError{Path: path, Err: ctx.Err()}
+		}
+		return nil, &ProbeError{Path: path, Err: classifyFailure("ffprobe", cmd.Path, err, stderr.Bytes())}
+	}
+
+	var times []float64
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		if line := strings.Trim(strings.TrimSpace(scanner.Text()), ","); line != "" {
+			if t := parseNumber(line); t > 0 {
+				times = append(times, t)
+			}
+		}
+	}
+	sort.Float64s(times)
+	return times, nil
+}
+
+// SplitParts cuts the range of the input selected by opts into the fewest
+// parts of at most partMB each that still leave every part the bitrate of
+// the source, and at least the minimum bitrates. The cuts are spread evenly
+// and moved to the nearest of keyframes, if one is close enough, so parts
+// start on a clean picture.
+func SplitParts(opts Options, info *MediaInfo, partMB float64, keyframes []float64) ([]Part, error) {
+	if partMB <= 0 || math.IsNaN(partMB) || math.IsInf(partMB, 0) {
+		return nil, fmt.Errorf("%w: part size must be greater than 0 MB", ErrInvalidSplit)
+	}
+	if info.Bitrate <= 0 {
+		return nil, fmt.Errorf("%w: the bitrate of the input is unknown", ErrInvalidSplit)
+	}
+	start, end, err := opts.Range(info.Duration)
+	if err != nil {
+		return nil, err
+	}
+
+	// info.Bitrate is in units of 1000 bits, the budget in units of 1024.
+	// Low bitrate sources still get enough parts for each to be planned
+	// without clamping.
+	sourceMB := info.Bitrate * 1000 / 1024 * (end - start) / 8192
+	neededMB := math.Max(sourceMB/overhead, MinTargetMB(end-start))
+	n := max(1, int(math.Ceil(neededMB/partMB)))
+	length := (end - start) / float64(n)
+
+	parts := make([]Part, n)
+	cut := start
+	for i := range parts {
+		parts[i].Start = cut
+		if i == n-1 {
+			cut = end
+		} else {
+			cut = nearestKeyframe(start+length*float64(i+1), length*keyframeWindow, keyframes)
+		}
+		parts[i].End = cut
+	}
+	return parts, nil
+}
+
+// nearestKeyframe returns the keyframe closest to t if it is within window
+// of it, and t otherwise.
+func nearestKeyframe(t, window float64, keyframes []float64) float64 {
+	best, bestDistance := t, window
+	for _, k := range keyframes {
+		if d := math.Abs(k - t); d <= bestDistance {
+			best, bestDistance = k, d
+		}
+	}
+	return best
+}
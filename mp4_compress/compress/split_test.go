@@ -0,0 +1,58 @@
+package compress
+
+import (
+	"context"
+	"testing"
+
+	"phergul/mp4_compress/compress/compresstest"
+)
+
+func TestSplitParts(t *testing.T) {
+	// 100 seconds at 4000 kbps is about 47 MB, so it takes three 20 MB parts,
+	// cut near 33.3 and 66.7 seconds.
+	runner, input := compresstest.New(t, compresstest.Script{
+		Duration:  "100",
+		Size:      50_000_000,
+		Keyframes: []float64{0, 10, 20, 32, 41, 50, 60, 67.5, 80, 90},
+	})
+	ctx := context.Background()
+	info, err := Probe(ctx, runner, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyframes, err := Keyframes(ctx, runner, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		opts      Options
+		keyframes []float64
+		want      []Part
+	}{
+		{name: "cut on keyframes", keyframes: keyframes, want: []Part{{0, 32}, {32, 67.5}, {67.5, 100}}},
+		{name: "exact cuts without keyframes", want: []Part{{0, 100.0 / 3}, {100.0 / 3, 200.0 / 3}, {200.0 / 3, 100}}},
+		{name: "no keyframe close enough", opts: Options{Start: 50}, keyframes: keyframes, want: []Part{{50, 75}, {75, 100}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, err := SplitParts(tt.opts, info, 20, tt.keyframes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != len(tt.want) {
+				t.Fatalf("SplitParts() = %v, want %v", parts, tt.want)
+			}
+			for i := range parts {
+				if !near(parts[i].Start, tt.want[i].Start) || !near(parts[i].End, tt.want[i].End) {
+					t.Fatalf("SplitParts() = %v, want %v", parts, tt.want)
+				}
+			}
+		})
+	}
+
+	if got := runner.Commands(t); len(got) != 2 {
+		t.Errorf("ran %d commands, want ffprobe twice:\n%v", len(got), got)
+	}
+}
@@ -0,0 +1,5 @@
+module phergul/mp4_compress
+
+go 1.25.3
+
+require golang.org/x/sys v0.36.0
@@ -58,7 +58,7 @@ $precompiledExists = Test-Path "$scriptDir\mp4_compress.exe"
 if ($goInstalled -and $goSourceExists) {
     try {
         Push-Location $scriptDir
-        go build -o "$installDir\mp4_compress.exe" .\mp4_compress.go 2>&1 | Out-Null
+        go build -o "$installDir\mp4_compress.exe" . 2>&1 | Out-Null
         Pop-Location
         Write-Host " BUILT FROM SOURCE" -ForegroundColor Green
     }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"phergul/mp4_compress/compress"
+)
+
+// videoExts are the extensions picked up when a directory is given as input.
+var videoExts = []string{".mp4", ".m4v", ".mov", ".mkv", ".webm", ".avi"}
+
+// batchRow is one line of the summary printed after a batch.
+type batchRow struct {
+	Input      string   `json:"input"`
+	Output     string   `json:"output,omitempty"`
+	Duration   float64  `json:"duration,omitempty"`
+	InputSize  int64    `json:"input_size,omitempty"`
+	OutputSize int64    `json:"output_size,omitempty"`
+	Bitrate    float64  `json:"bitrate_kbps,omitempty"`
+	SSIM       *float64 `json:"ssim,omitempty"`
+	PSNR       *float64 `json:"psnr,omitempty"` // unset for identical frames
+	Action     string   `json:"action,omitempty"`
+	Status     string   `json:"status"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Ratio is the output size as a fraction of the input size.
+func (row batchRow) Ratio() float64 {
+	if row.InputSize == 0 {
+		return 0
+	}
+	return float64(row.OutputSize) / float64(row.InputSize)
+}
+
+// budgetShare is the part of a shared -total budget given to one input.
+type budgetShare struct {
+	Input    string  `json:"input"`
+	Duration float64 `json:"duration,omitempty"`
+	TargetMB float64 `json:"target_mb,omitempty"`
+	Floored  bool    `json:"floored,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// batchReporter is implemented by the reporters that can follow several
+// jobs running at once.
+type batchReporter interface {
+	allocation(shares []budgetShare, totalMB float64, ok bool)
+	jobStart(input, output string)
+	jobEvent(input string, e compress.Event)
+	jobEnd(row batchRow)
+	summary(rows []batchRow)
+	budget(usedBytes int64, totalMB float64)
+	split(input string, parts []compress.Part, partMB float64)
+	watching(dir, outDir string)
+}
+
+// runBatch compresses every input into outDir, or next to the input when
+// outDir is empty, using base for everything but the paths. When totalMB is
+// positive the inputs share that budget instead of each getting
+// base.TargetMB or base.CRF. With queuePath the jobs are also kept in a
+// queue file for resume. It returns false if any job failed.
+func runBatch(ctx context.Context, r batchReporter, base compress.Options, inputs []string, outDir string, workers int, totalMB float64, queuePath string) (bool, error) {
+	if outDir != "" {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return false, fmt.Errorf("cannot create output directory: %v", err)
+		}
+	}
+
+	// Name the outputs after the codec the jobs will really use, which a
+	// fallback to libx264 can put in a different container.
+	codec, err := compress.ResolveCodec(ctx, base)
+	if err != nil {
+		return false, err
+	}
+	jobs := make([]compress.Options, len(inputs))
+	outputs := make(map[string]string)
+	for i, input := range inputs {
+		output := batchOutput(input, outDir, codec.Ext())
+		if other, ok := outputs[output]; ok {
+			return false, fmt.Errorf("%s and %s would both be written to %s", other, input, output)
+		}
+		outputs[output] = input
+
+		jobs[i] = base
+		jobs[i].Input = input
+		jobs[i].Output = output
+		followJob(r, &jobs[i])
+	}
+
+	rows := make([]batchRow, len(jobs))
+	var runnable []compress.Options
+	var indexes []int
+	if totalMB > 0 {
+		shares, ok := allocateBudget(ctx, jobs, totalMB)
+		r.allocation(shares, totalMB, ok)
+		for i, share := range shares {
+			if share.Error != "" {
+				rows[i] = batchRow{Input: share.Input, Status: "failed", Error: share.Error}
+				r.jobEnd(rows[i])
+				continue
+			}
+			jobs[i].TargetMB = share.TargetMB
+			runnable = append(runnable, jobs[i])
+			indexes = append(indexes, i)
+		}
+	} else {
+		runnable = jobs
+		for i := range jobs {
+			indexes = append(indexes, i)
+		}
+	}
+
+	if queuePath != "" {
+		q, err := createQueue(queuePath, runnable)
+		if err != nil {
+			return false, fmt.Errorf("cannot create queue: %v", err)
+		}
+		queued := make([]int, len(runnable))
+		for i := range queued {
+			queued[i] = i
+		}
+		for i, row := range runQueue(ctx, r, q, runnable, queued, workers) {
+			rows[indexes[i]] = row
+		}
+	} else {
+		compress.CompressAll(ctx, runnable, workers, func(i int, jr compress.JobResult) {
+			rows[indexes[i]] = summarize(jr)
+			r.jobEnd(rows[indexes[i]])
+		})
+	}
+	r.summary(rows)
+
+	if totalMB > 0 {
+		var used int64
+		for _, row := range rows {
+			used += row.OutputSize
+		}
+		r.budget(used, totalMB)
+	}
+
+	for _, row := range rows {
+		if row.Status != "ok" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// followJob reports the events of job through r as one job of a batch,
+// starting with jobStart on its first event.
+func followJob(r batchReporter, job *compress.Options) {
+	input, output := job.Input, job.Output
+	started := false
+	job.OnEvent = func(e compress.Event) {
+		if !started {
+			started = true
+			r.jobStart(input, output)
+		}
+		r.jobEvent(input, e)
+	}
+}
+
+// allocateBudget probes every job, storing the result in its Info, and
+// splits totalMB between them in proportion to the duration each will
+// encode. Jobs that cannot be probed get no share and an Error.
+func allocateBudget(ctx context.Context, jobs []compress.Options, totalMB float64) ([]budgetShare, bool) {
+	shares := make([]budgetShare, len(jobs))
+	var durations []float64
+	var indexes []int
+	for i := range jobs {
+		shares[i].Input = jobs[i].Input
+		info, err := compress.Probe(ctx, jobs[i].Runner, jobs[i].Input)
+		if err != nil {
+			shares[i].Error = err.Error()
+			continue
+		}
+		start, end, err := jobs[i].Range(info.Duration)
+		if err != nil {
+			shares[i].Error = err.Error()
+			continue
+		}
+		jobs[i].Info = info
+		shares[i].Duration = end - start
+		durations = append(durations, end-start)
+		indexes = append(indexes, i)
+	}
+
+	targets, ok := compress.AllocateBudget(totalMB, durations)
+	for j, i := range indexes {
+		shares[i].TargetMB = targets[j]
+		shares[i].Floored = targets[j] <= compress.MinTargetMB(durations[j])
+	}
+	return shares, ok
+}
+
+func summarize(jr compress.JobResult) batchRow {
+	row := batchRow{Input: jr.Options.Input, Status: "ok"}
+	if info, err := os.Stat(jr.Options.Input); err == nil {
+		row.InputSize = info.Size()
+	}
+
+	switch {
+	case compress.IsCanceled(jr.Err):
+		row.Status = "cancelled"
+	case jr.Err != nil:
+		row.Status = "failed"
+		row.Error = jr.Err.Error()
+	default:
+		row.Output = jr.Result.Output
+		row.Duration = jr.Result.Plan.Duration
+		row.OutputSize = jr.Result.Size
+		row.Action = string(jr.Result.Action)
+		row.Bitrate = math.Round(jr.Result.Bitrate())
+		if q := jr.Result.Quality; q != nil {
+			row.SSIM = &q.SSIM
+			if q.HasPSNR() {
+				row.PSNR = &q.PSNR
+			}
+		}
+		if jr.Options.MaxRetries > 0 && jr.Result.OverTarget {
+			row.Status = "over target"
+		}
+	}
+	return row
+}
+
+// batchOutput names the output for input the way the context-menu script
+// does: <name>_compressed.mp4, or with the codec's extension.
+func batchOutput(input, outDir, ext string) string {
+	name := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input)) + "_compressed" + ext
+	if outDir == "" {
+		return filepath.Join(filepath.Dir(input), name)
+	}
+	return filepath.Join(outDir, name)
+}
+
+// expandInputs turns the batch arguments into a list of files. Directories
+// contribute the videos directly inside them and patterns are globbed here
+// as well, since Windows shells leave that to the program.
+func expandInputs(args []string) ([]string, error) {
+	var inputs []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		key, err := filepath.Abs(path)
+		if err != nil {
+			key = path
+		}
+		if !seen[key] {
+			seen[key] = true
+			inputs = append(inputs, path)
+		}
+	}
+
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		switch {
+		case err == nil && info.IsDir():
+			entries, err := os.ReadDir(arg)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() && slices.Contains(videoExts, strings.ToLower(filepath.Ext(entry.Name()))) {
+					add(filepath.Join(arg, entry.Name()))
+				}
+			}
+		case err == nil:
+			add(arg)
+		case strings.ContainsAny(arg, "*?["):
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", arg)
+			}
+			for _, match := range matches {
+				add(match)
+			}
+		default:
+			return nil, err
+		}
+	}
+
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("no input videos found")
+	}
+	return inputs, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"path/filepath"
+
+	"phergul/mp4_compress/compress"
+)
+
+// encodeFlags are the encoder, audio and scaling options shared by every
+// mode that compresses videos.
+type encodeFlags struct {
+	audio         *string
+	audioTrack    *int
+	codec         *string
+	preset        *string
+	tune          *string
+	speed         *int
+	codecFallback *bool
+	maxWidth      *int
+	maxHeight     *int
+	maxFPS        *float64
+	noAutoScale   *bool
+	force         *bool
+	measure       *bool
+	retries       *int
+	logDir        *string
+}
+
+// addEncodeFlags defines the shared encoding flags on fs.
+func addEncodeFlags(fs *flag.FlagSet) *encodeFlags {
+	return &encodeFlags{
+		audio:         fs.String("audio", "auto", "Audio handling: auto (one track), keep (all tracks), stereo (downmix one track) or none"),
+		audioTrack:    fs.Int("audio-track", 0, "Audio track to keep with -audio auto or stereo, counting audio tracks from 0"),
+		codec:         fs.String("codec", "x264", "Video encoder: x264, x265, vp9, av1 (libaom) or svtav1 (one pass, as ffmpeg has no two-pass svtav1)"),
+		preset:        fs.String("preset", "", "Encoder preset, e.g. slow for x264/x265 or 0-13 for svtav1"),
+		tune:          fs.String("tune", "", "Encoder tuning for x264/x265, e.g. film or animation"),
+		speed:         fs.Int("speed", -1, "Encoder speed: -cpu-used for vp9/av1, preset number for svtav1 (-1 for the default)"),
+		codecFallback: fs.Bool("codec-fallback", false, "Use x264 if ffmpeg lacks the requested encoder instead of failing"),
+		maxWidth:      fs.Int("max-width", 0, "Largest output width in pixels (0 for no limit)"),
+		maxHeight:     fs.Int("max-height", 0, "Largest output height in pixels (0 for no limit)"),
+		maxFPS:        fs.Float64("max-fps", 0, "Highest output frame rate (0 for no limit)"),
+		noAutoScale:   fs.Bool("no-auto-scale", false, "Never lower the resolution or frame rate beyond the -max-* limits"),
+		force:         fs.Bool("force", false, "Re-encode inputs that are already within the target size instead of copying or remuxing them"),
+		measure:       fs.Bool("measure", false, "Compare the output with the input afterwards and report SSIM and PSNR"),
+		retries:       fs.Int("retries", 0, "Check the output size and re-run pass 2 up to N times while it is over the target"),
+		logDir:        fs.String("log-dir", "", "Folder to save the ffmpeg log of a failed job in (default: next to the output)"),
+	}
+}
+
+// options returns the compress options set by the flags, with the error
+// message naming the flag that is invalid.
+func (f *encodeFlags) options() (compress.Options, error) {
+	opts := compress.Options{
+		Preset:        *f.preset,
+		Tune:          *f.tune,
+		CodecFallback: *f.codecFallback,
+		AudioTrack:    *f.audioTrack,
+		MaxWidth:      *f.maxWidth,
+		MaxHeight:     *f.maxHeight,
+		MaxFPS:        *f.maxFPS,
+		NoAutoScale:   *f.noAutoScale,
+		MaxRetries:    *f.retries,
+		Force:         *f.force,
+		Measure:       *f.measure,
+	}
+
+	var err error
+	if opts.Codec, err = compress.ParseCodec(*f.codec); err != nil {
+		return opts, fmt.Errorf("Invalid -codec: %v", err)
+	}
+	if *f.speed >= 0 {
+		opts.Speed = f.speed
+	}
+	if opts.AudioMode, err = compress.ParseAudioMode(*f.audio); err != nil {
+		return opts, fmt.Errorf("Invalid -audio: %v", err)
+	}
+	if *f.logDir != "" {
+		// Absolute, so a resumed queue writes its logs to the same place.
+		if opts.LogDir, err = filepath.Abs(*f.logDir); err != nil {
+			return opts, fmt.Errorf("Invalid -log-dir: %v", err)
+		}
+	}
+	return opts, nil
+}
+
+// validMB reports whether a size flag in MB is unset (0) or a usable size.
+func validMB(mb float64) bool {
+	return mb >= 0 && !math.IsInf(mb, 0)
+}
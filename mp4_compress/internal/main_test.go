@@ -0,0 +1,11 @@
+package main
+
+import (
+	"testing"
+
+	"phergul/mp4_compress/compress/compresstest"
+)
+
+func TestMain(m *testing.M) {
+	compresstest.Main(m)
+}
@@ -1,100 +1,286 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"flag"
 	"fmt"
-	"log"
-	"math"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+
+	"phergul/mp4_compress/compress"
 )
 
-var logFiles []string = []string{"ffmpeg2pass-0.log", "ffmpeg2pass-0.log.mbtree"}
+// exitCanceled is the exit status when a run is stopped by SIGINT or SIGTERM,
+// following the shell convention of 128 + SIGINT.
+const exitCanceled = 130
 
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Printf("Usage: %s <input.mp4> <target_size_MB> <output.mp4>\n", os.Args[0])
-		os.Exit(1)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "probe":
+			runProbe(os.Args[2:])
+			return
+		case "watch":
+			runWatch(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "resume":
+			runResume(os.Args[2:])
+			return
+		}
 	}
 
-	input := os.Args[1]
-	targetSizeMB, err := strconv.ParseFloat(os.Args[2], 64)
-	if err != nil {
-		log.Fatalf("Error converting target size (MB) to float: %v", err)
+	jsonOutput := flag.Bool("json", false, "Emit one JSON object per event on stdout instead of human-readable output")
+	startFlag := flag.String("start", "", "Start of the range to keep, in seconds or HH:MM:SS.ms")
+	endFlag := flag.String("end", "", "End of the range to keep, in seconds or HH:MM:SS.ms")
+	durationFlag := flag.String("duration", "", "Length of the range to keep, in seconds or HH:MM:SS.ms (instead of -end)")
+	encode := addEncodeFlags(flag.CommandLine)
+	crf := flag.Float64("crf", 0, "Constant-quality mode: one pass at this CRF instead of a target size, e.g. 23 for x264, 28 for x265, 31 for vp9, 30 for av1, 35 for svtav1")
+	minSSIM := flag.Float64("min-ssim", 0, "Quality target: encode at the highest CRF whose samples reach this SSIM, e.g. 0.95; a target size becomes an upper bound")
+	target := flag.Float64("target", 0, "Target size in MB for every input; enables batch mode, where all arguments are inputs")
+	total := flag.Float64("total", 0, "Batch mode: share this many MB between all inputs in proportion to their duration (instead of -target)")
+	targetsFlag := flag.String("targets", "", "Several target sizes in MB, e.g. 8,25,50: one pass 1 and a pass 2 per size, written as <output name>_<size>MB")
+	splitMB := flag.Float64("split", 0, "Split mode: cut the input into the fewest parts of at most this many MB, named <name>_partNN, with a <name>_parts.json manifest")
+	outDir := flag.String("out-dir", "", "Batch and split mode: directory for the outputs (default: next to each input); with -crf or -min-ssim, enables batch mode")
+	queuePath := flag.String("queue", "", "Batch mode: keep the jobs and their progress in this file, so resume can finish them after an interruption")
+	jobs := flag.Int("jobs", 1, "Batch and split mode: number of videos or parts to compress at once")
+	flag.Usage = func() {
+		fmt.Printf("Usage: %s [options] <input.mp4> <target_size_MB> <output.mp4>\n", os.Args[0])
+		fmt.Printf("       %s [options] <input.mp4> <target_size_MB> <output.gif|output.webp>\n", os.Args[0])
+		fmt.Printf("       %s -target <MB> [options] <input|dir|glob>...\n", os.Args[0])
+		fmt.Printf("       %s -total <MB> [options] <input|dir|glob>...\n", os.Args[0])
+		fmt.Printf("       %s -crf <N> [options] <input.mp4> <output.mp4>\n", os.Args[0])
+		fmt.Printf("       %s -crf <N> -out-dir <dir> [options] <input|dir|glob>...\n", os.Args[0])
+		fmt.Printf("       %s -min-ssim <S> [options] <input.mp4> [<max_size_MB>] <output.mp4>\n", os.Args[0])
+		fmt.Printf("       %s -targets <MB,MB,...> [options] <input.mp4> <output.mp4>\n", os.Args[0])
+		fmt.Printf("       %s -split <MB> [-out-dir <dir>] [options] <input.mp4>\n", os.Args[0])
+		fmt.Printf("       %s resume [-jobs <N>] <queue file>\n", os.Args[0])
+		fmt.Printf("       %s watch -target <MB> [options] <dir>\n", os.Args[0])
+		fmt.Printf("       %s serve [-addr <host:port>] [options]\n", os.Args[0])
+		fmt.Printf("       %s probe [-json] <file>...\n", os.Args[0])
+		flag.PrintDefaults()
 	}
-	output := os.Args[3]
+	flag.Parse()
 
-	if targetSizeMB <= 0 {
-		log.Fatal("Target size must be greater than 0 MB")
+	text := &textReporter{}
+	var r reporter = text
+	var br batchReporter = text
+	if *jsonOutput {
+		j := newJSONReporter(os.Stdout)
+		r, br = j, j
 	}
 
-	duration, err := getDuration(input)
-	if err != nil {
-		log.Fatalf("Error getting duration: %v", err)
+	args := flag.Args()
+	if *target != 0 && *total != 0 {
+		fatal(r, "-target and -total cannot be used together")
+	}
+	if !validMB(*target) {
+		fatal(r, "-target must be greater than 0 MB")
+	}
+	if !validMB(*total) {
+		fatal(r, "-total must be greater than 0 MB")
+	}
+	if *crf != 0 && *minSSIM != 0 {
+		fatal(r, "-crf and -min-ssim cannot be used together")
+	}
+	if *crf != 0 && (*target != 0 || *total != 0) {
+		fatal(r, "-crf cannot be used with -target or -total")
+	}
+	quality := *crf != 0 || *minSSIM != 0
+	if *splitMB != 0 && (quality || *target != 0 || *total != 0) {
+		fatal(r, "-split cannot be used with -target, -total, -crf or -min-ssim")
+	}
+	if *targetsFlag != "" && (quality || *target != 0 || *total != 0 || *splitMB != 0) {
+		fatal(r, "-targets cannot be used with -target, -total, -crf, -min-ssim or -split")
+	}
+	if !validMB(*splitMB) {
+		fatal(r, "-split must be greater than 0 MB")
+	}
+	batch := *target != 0 || *total != 0 || (quality && *outDir != "")
+	// Without a quality mode the target size is required; -min-ssim takes it
+	// as an optional upper bound and -crf not at all.
+	argsOK := len(args) >= 3
+	if *crf != 0 {
+		argsOK = len(args) == 2
+	} else if *minSSIM != 0 {
+		argsOK = len(args) == 2 || len(args) == 3
+	}
+	if *splitMB != 0 {
+		batch, argsOK = false, len(args) == 1
+	}
+	if *targetsFlag != "" {
+		argsOK = len(args) == 2
+	}
+	if *queuePath != "" && !batch {
+		fatal(r, "-queue can only be used in batch mode")
+	}
+	if (batch && len(args) < 1) || (!batch && !argsOK) {
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	totalBitrate := (targetSizeMB * 8192) / duration
-	//account for overhead
-	totalBitrate *= 0.97
-	audioBitrate := 128.0
-	videoBitrate := math.Max(totalBitrate-audioBitrate, 100.0)
-
-	fmt.Printf("Target: %.2f MB (%.1f sec)\n", targetSizeMB, duration)
-	fmt.Printf("Video bitrate: %.0f kbps, Audio: %.0f kbps\n", videoBitrate, audioBitrate)
+	opts, err := encode.options()
+	if err != nil {
+		fatal(r, "%v", err)
+	}
+	opts.TargetMB = *target
+	opts.CRF = *crf
+	opts.MinSSIM = *minSSIM
+	if opts.Start, err = parseTimeFlag(*startFlag); err != nil {
+		fatal(r, "Invalid -start: %v", err)
+	}
+	if opts.End, err = parseTimeFlag(*endFlag); err != nil {
+		fatal(r, "Invalid -end: %v", err)
+	}
+	if opts.Duration, err = parseTimeFlag(*durationFlag); err != nil {
+		fatal(r, "Invalid -duration: %v", err)
+	}
 
-	pass1 := exec.Command("ffmpeg", "-y", "-i", input,
-		"-b:v", fmt.Sprintf("%.0fk", videoBitrate),
-		"-b:a", fmt.Sprintf("%.0fk", audioBitrate),
-		"-c:v", "libx264", "-pass", "1", "-an", "-f", "mp4", os.DevNull,
-	)
-	pass2 := exec.Command("ffmpeg", "-y", "-i", input,
-		"-b:v", fmt.Sprintf("%.0fk", videoBitrate),
-		"-b:a", fmt.Sprintf("%.0fk", audioBitrate),
-		"-c:v", "libx264", "-pass", "2", output,
-	)
+	if !batch && *splitMB == 0 {
+		opts.Input = args[0]
+		opts.Output = args[1]
+		opts.OnEvent = r.event
+		if len(args) >= 3 {
+			opts.Output = args[2]
+			opts.TargetMB, err = strconv.ParseFloat(args[1], 64)
+			if err != nil {
+				fatal(r, "Error converting target size (MB) to float: %v", err)
+			}
+		}
+	}
 
-	pass1.Stdout = nil
-	pass1.Stderr = nil
-	pass2.Stdout = nil
-	pass2.Stderr = nil
+	// Cancel on Ctrl-C or SIGTERM so Compress can stop ffmpeg and remove the
+	// partial output and pass logs before we exit. A second signal falls back
+	// to the default behaviour and kills us outright.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	fmt.Println("Running pass 1...")
-	if err := pass1.Run(); err != nil {
-		log.Fatalf("Pass 1 failed: %v", err)
+	if *targetsFlag != "" {
+		targets, err := parseTargets(*targetsFlag, opts.Output)
+		if err != nil {
+			fatal(r, "Invalid -targets: %v", err)
+		}
+		results, err := compress.CompressTargets(ctx, opts, targets)
+		if compress.IsCanceled(err) {
+			r.fail("Compression cancelled")
+			os.Exit(exitCanceled)
+		}
+		if err != nil {
+			fatal(r, "Compression failed: %v", err)
+		}
+		failed := false
+		for _, jr := range results {
+			switch {
+			case compress.IsCanceled(jr.Err):
+				r.fail(fmt.Sprintf("%s: compression cancelled", jr.Options.Output))
+				failed = true
+			case jr.Err != nil:
+				r.fail(fmt.Sprintf("%s: compression failed: %v", jr.Options.Output, jr.Err))
+				failed = true
+			default:
+				r.done(jr.Result)
+				failed = failed || (*encode.retries > 0 && jr.Result.OverTarget)
+			}
+		}
+		if ctx.Err() != nil {
+			os.Exit(exitCanceled)
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
 	}
 
-	fmt.Println("Running pass 2...")
-	if err := pass2.Run(); err != nil {
-		log.Fatalf("Pass 2 failed: %v", err)
+	if *splitMB != 0 {
+		ok, err := runSplit(ctx, br, opts, args[0], *outDir, *splitMB, *jobs)
+		if compress.IsCanceled(err) || ctx.Err() != nil {
+			os.Exit(exitCanceled)
+		}
+		if err != nil {
+			fatal(r, "Split failed: %v", err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
 	}
 
-	for _, logFile := range logFiles {
-		if _, err := os.Stat(logFile); err == nil {
-			os.Remove(logFile)
+	if batch {
+		inputs, err := expandInputs(args)
+		if err != nil {
+			fatal(r, "Error reading inputs: %v", err)
+		}
+		ok, err := runBatch(ctx, br, opts, inputs, *outDir, *jobs, *total, *queuePath)
+		if err != nil {
+			fatal(r, "Batch failed: %v", err)
+		}
+		if ctx.Err() != nil {
+			os.Exit(exitCanceled)
 		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
 	}
 
-	fmt.Printf("Compression complete: %s\n", output)
+	res, err := compress.Compress(ctx, opts)
+	if compress.IsCanceled(err) {
+		r.fail("Compression cancelled")
+		os.Exit(exitCanceled)
+	}
+	if err != nil {
+		fatal(r, "Compression failed: %v", err)
+	}
+	r.done(res)
+	if *encode.retries > 0 && res.OverTarget {
+		fatal(r, "Output is still over %.2f MB after %d attempts", res.Plan.TargetMB, res.Attempts)
+	}
 }
 
-func getDuration(filename string) (float64, error) {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-show_entries", "format=duration",
-		"-of", "default=noprint_wrappers=1:nokey=1",
-		filename,
-	)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
-		return 0, fmt.Errorf("ffprobe failed: %v", err)
+// parseTargets parses the -targets list and names an output for each size
+// after output, e.g. clip_8MB.mp4 for clip.mp4.
+func parseTargets(list, output string) ([]compress.Target, error) {
+	ext := filepath.Ext(output)
+	base := strings.TrimSuffix(output, ext)
+	var targets []compress.Target
+	seen := make(map[float64]bool)
+	for _, field := range strings.Split(list, ",") {
+		mb, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		if mb <= 0 {
+			return nil, compress.ErrInvalidTarget
+		}
+		if seen[mb] {
+			return nil, fmt.Errorf("%g MB is listed twice", mb)
+		}
+		seen[mb] = true
+		targets = append(targets, compress.Target{TargetMB: mb, Output: fmt.Sprintf("%s_%gMB%s", base, mb, ext)})
 	}
+	return targets, nil
+}
 
-	duration, err := strconv.ParseFloat(strings.TrimSpace(out.String()), 64)
-	if err != nil {
-		return 0, fmt.Errorf("invalid duration: %v", err)
+// parseTimeFlag parses an optional timestamp flag, treating "" as 0.
+func parseTimeFlag(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
 	}
-	return duration, nil
+	return compress.ParseTimestamp(value)
+}
+
+// fatal reports the formatted message through r and exits with status 1.
+func fatal(r reporter, format string, args ...any) {
+	r.fail(fmt.Sprintf(format, args...))
+	os.Exit(1)
 }
@@ -111,7 +111,24 @@ if (-not (Test-Path $compressor)) {
     exit
 }
 
-Start-Process -NoNewWindow -Wait -FilePath $compressor -ArgumentList "`"$inputPath`"", $targetSize, "`"$outputPath`""
+# Progress still goes to the console; the error message, if any, is kept
+# so the message box can show why the compression failed. Each run gets its
+# own file, as several can run at once.
+$errorLog = New-TemporaryFile
+try {
+    $process = Start-Process -NoNewWindow -Wait -PassThru -FilePath $compressor -ArgumentList "`"$inputPath`"", $targetSize, "`"$outputPath`"" -RedirectStandardError $errorLog.FullName
+    $message = (Get-Content $errorLog.FullName -Raw -ErrorAction SilentlyContinue)
+}
+finally {
+    Remove-Item $errorLog.FullName -ErrorAction SilentlyContinue
+}
+
+if ($process.ExitCode -ne 0) {
+    if (-not $message) { $message = "The compressor exited with code $($process.ExitCode)." }
+    [System.Windows.Forms.MessageBox]::Show($message.Trim(),"Compression Failed")
+    Read-Host "Press Enter to close"
+    exit 1
+}
 
 [System.Windows.Forms.MessageBox]::Show("Compression complete:`n$outputPath","Done")	
 Read-Host "Press Enter to close"
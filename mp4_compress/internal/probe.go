@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"phergul/mp4_compress/compress"
+)
+
+// runProbe implements `mp4_compress probe [-json] <file>...`.
+func runProbe(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "Print the probe result as JSON")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s probe [options] <file>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	failed := false
+	for i, path := range fs.Args() {
+		info, err := compress.Probe(context.Background(), nil, path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+
+		if *jsonOutput {
+			out, _ := json.MarshalIndent(info, "", "  ")
+			fmt.Println(string(out))
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		printMediaInfo(info)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func printMediaInfo(info *compress.MediaInfo) {
+	fmt.Printf("File:      %s\n", info.Path)
+	fmt.Printf("Container: %s\n", info.Container)
+	fmt.Printf("Duration:  %s (%.1f sec)\n", compress.FormatClock(info.Duration), info.Duration)
+	if info.Size > 0 {
+		fmt.Printf("Size:      %s\n", formatMB(info.Size))
+	}
+	if info.Bitrate > 0 {
+		fmt.Printf("Bitrate:   %.0f kbps\n", info.Bitrate)
+	}
+
+	for _, v := range info.Video {
+		details := []string{v.Codec, fmt.Sprintf("%dx%d", v.Width, v.Height)}
+		if v.FPS > 0 {
+			details = append(details, fmt.Sprintf("%.2f fps", v.FPS))
+		}
+		if v.Rotation != 0 {
+			details = append(details, fmt.Sprintf("rotated %d°", v.Rotation))
+		}
+		if v.Bitrate > 0 {
+			details = append(details, fmt.Sprintf("%.0f kbps", v.Bitrate))
+		}
+		fmt.Printf("Video #%d:  %s\n", v.Index, strings.Join(details, ", "))
+	}
+	for _, a := range info.Audio {
+		details := []string{a.Codec, fmt.Sprintf("%d ch", a.Channels), fmt.Sprintf("%d Hz", a.SampleRate)}
+		if a.Bitrate > 0 {
+			details = append(details, fmt.Sprintf("%.0f kbps", a.Bitrate))
+		}
+		if a.Language != "" {
+			details = append(details, a.Language)
+		}
+		fmt.Printf("Audio #%d:  %s\n", a.Index, strings.Join(details, ", "))
+	}
+	if len(info.Audio) == 0 {
+		fmt.Println("Audio:     none")
+	}
+	for _, s := range info.Subtitles {
+		details := []string{s.Codec}
+		if s.Language != "" {
+			details = append(details, s.Language)
+		}
+		fmt.Printf("Subtitle #%d: %s\n", s.Index, strings.Join(details, ", "))
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"phergul/mp4_compress/compress"
+)
+
+// The states of a queued job. A job stopped in pass1 or pass2 is run again
+// by resume; one stopped in pass2 skips pass 1 if its stats are still in
+// its work directory.
+const (
+	stateQueued = "queued"
+	statePass1  = "pass1"
+	statePass2  = "pass2"
+	stateDone   = "done"
+	stateFailed = "failed"
+)
+
+// jobQueue is a batch kept in a file so that `mp4_compress resume` can
+// finish it after the process was stopped or the machine rebooted. Every
+// job has a work directory next to the file for its pass logs.
+type jobQueue struct {
+	path string
+	mu   sync.Mutex
+	Jobs []queuedJob `json:"jobs"`
+}
+
+type queuedJob struct {
+	Options compress.Options `json:"options"`
+	State   string           `json:"state"`
+	Size    int64            `json:"size,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// createQueue writes a new queue file at path for jobs, giving each of them
+// a work directory. Paths are stored absolute so resume can run from
+// anywhere. It refuses to replace an existing queue.
+func createQueue(path string, jobs []compress.Options) (*jobQueue, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists; finish it with resume or remove it", path)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	q := &jobQueue{path: path, Jobs: make([]queuedJob, len(jobs))}
+	for i := range jobs {
+		jobs[i].WorkDir = filepath.Join(path+".work", strconv.Itoa(i+1))
+		stored := jobs[i]
+		stored.OnEvent = nil
+		if stored.Input, err = filepath.Abs(stored.Input); err != nil {
+			return nil, err
+		}
+		if stored.Output, err = filepath.Abs(stored.Output); err != nil {
+			return nil, err
+		}
+		q.Jobs[i] = queuedJob{Options: stored, State: stateQueued}
+	}
+	return q, q.save()
+}
+
+// loadQueue reads the queue file at path.
+func loadQueue(path string) (*jobQueue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	q := &jobQueue{path: path}
+	if err := json.Unmarshal(data, q); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return q, nil
+}
+
+// track records the passes of job i in the queue as they start. Errors
+// saving the queue are reported through r as warnings.
+func (q *jobQueue) track(r batchReporter, i int, job *compress.Options) {
+	onEvent := job.OnEvent
+	job.OnEvent = func(e compress.Event) {
+		if e.Kind == compress.EventPassStart {
+			state := statePass1
+			if e.Pass > 1 {
+				state = statePass2
+			}
+			q.update(r, i, func(j *queuedJob) { j.State = state })
+		}
+		if onEvent != nil {
+			onEvent(e)
+		}
+	}
+}
+
+// finish records the outcome of job i and removes its work directory. A
+// cancelled job keeps its state and pass logs for resume.
+func (q *jobQueue) finish(r batchReporter, i int, jr compress.JobResult) {
+	if compress.IsCanceled(jr.Err) {
+		return
+	}
+	q.update(r, i, func(j *queuedJob) {
+		if jr.Err != nil {
+			j.State, j.Error = stateFailed, jr.Err.Error()
+		} else {
+			j.State, j.Size, j.Error = stateDone, jr.Result.Size, ""
+		}
+	})
+	os.RemoveAll(jr.Options.WorkDir)
+	// Only succeeds once every job's directory is gone.
+	os.Remove(q.path + ".work")
+}
+
+func (q *jobQueue) update(r batchReporter, i int, f func(*queuedJob)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	f(&q.Jobs[i])
+	if err := q.save(); err != nil {
+		r.jobEvent(q.Jobs[i].Options.Input, compress.Event{Kind: compress.EventWarning, Message: fmt.Sprintf("saving queue: %v", err)})
+	}
+}
+
+func (q *jobQueue) save() error {
+	return writeJSONFile(q.path, q)
+}
+
+// runQueue runs the jobs of q at the given indexes, recording their
+// progress in q, and returns their summary rows.
+func runQueue(ctx context.Context, r batchReporter, q *jobQueue, jobs []compress.Options, indexes []int, workers int) []batchRow {
+	for j := range jobs {
+		q.track(r, indexes[j], &jobs[j])
+	}
+	rows := make([]batchRow, len(jobs))
+	compress.CompressAll(ctx, jobs, workers, func(j int, jr compress.JobResult) {
+		q.finish(r, indexes[j], jr)
+		rows[j] = summarize(jr)
+		r.jobEnd(rows[j])
+	})
+	return rows
+}
+
+// runResume implements `mp4_compress resume [options] <queue file>`: it runs
+// the jobs of a queue written by batch mode's -queue that have not finished.
+func runResume(args []string) {
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "Emit one JSON object per event on stdout instead of human-readable output")
+	workers := fs.Int("jobs", 1, "Number of videos to compress at once")
+	retryFailed := fs.Bool("retry-failed", false, "Also run the jobs that failed")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s resume [options] <queue file>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	text := &textReporter{}
+	var r reporter = text
+	var br batchReporter = text
+	if *jsonOutput {
+		j := newJSONReporter(os.Stdout)
+		r, br = j, j
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	q, err := loadQueue(fs.Arg(0))
+	if err != nil {
+		fatal(r, "Cannot read queue: %v", err)
+	}
+	var jobs []compress.Options
+	var indexes []int
+	for i, job := range q.Jobs {
+		if job.State == stateDone || (job.State == stateFailed && !*retryFailed) {
+			continue
+		}
+		followJob(br, &job.Options)
+		jobs = append(jobs, job.Options)
+		indexes = append(indexes, i)
+	}
+	if len(jobs) == 0 {
+		if !*jsonOutput {
+			fmt.Println("Nothing to resume: every job has finished")
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	rows := runQueue(ctx, br, q, jobs, indexes, *workers)
+	br.summary(rows)
+	if ctx.Err() != nil {
+		os.Exit(exitCanceled)
+	}
+	for _, row := range rows {
+		if row.Status != "ok" {
+			os.Exit(1)
+		}
+	}
+}
+
+// writeJSONFile writes v to path as indented JSON through a temporary file,
+// so a crash never leaves it half written.
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
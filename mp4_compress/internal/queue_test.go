@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"phergul/mp4_compress/compress"
+	"phergul/mp4_compress/compress/compresstest"
+)
+
+func TestQueueResume(t *testing.T) {
+	runner, input := compresstest.New(t, compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 1024})
+	failing := runner
+	dir := filepath.Dir(input)
+	failing.Script.FailPass, failing.Script.Log = -1, filepath.Join(dir, "failing.log")
+	r := newJSONReporter(io.Discard)
+
+	jobs := []compress.Options{
+		{Input: input, Output: filepath.Join(dir, "first.mp4"), TargetMB: 2, Force: true, Runner: runner},
+		{Input: input, Output: filepath.Join(dir, "second.mp4"), TargetMB: 2, Force: true, Runner: failing},
+	}
+	q, err := createQueue(filepath.Join(dir, "queue.json"), jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first job is stopped as pass 2 starts, as if the process were
+	// interrupted; the second fails.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs[0].OnEvent = func(e compress.Event) {
+		if e.Kind == compress.EventPassStart && e.Pass == 2 {
+			cancel()
+		}
+	}
+	runQueue(ctx, r, q, jobs, []int{0, 1}, 1)
+
+	q, err = loadQueue(q.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := q.Jobs[0], q.Jobs[1]
+	if first.State != statePass2 {
+		t.Errorf("interrupted job is %s, want %s", first.State, statePass2)
+	}
+	if _, err := os.Stat(first.Options.WorkDir); err != nil {
+		t.Errorf("interrupted job lost its work directory: %v", err)
+	}
+	if second.State != stateQueued && second.State != stateFailed {
+		t.Errorf("second job is %s", second.State)
+	}
+
+	// Resume as runResume does, with the jobs that have not finished.
+	var resumed []compress.Options
+	var indexes []int
+	for i, job := range q.Jobs {
+		if job.State == stateDone || job.State == stateFailed {
+			continue
+		}
+		job.Options.Runner = jobs[i].Runner
+		resumed = append(resumed, job.Options)
+		indexes = append(indexes, i)
+	}
+	before := len(runner.Commands(t))
+	rows := runQueue(context.Background(), r, q, resumed, indexes, 1)
+	if len(rows) != 2 || rows[0].Status != "ok" || rows[1].Status == "ok" {
+		t.Fatalf("resumed rows = %+v, want the first job ok and the second failed", rows)
+	}
+	var passes []string
+	for _, command := range runner.Commands(t)[before:] {
+		if strings.Contains(command, "-pass ") {
+			passes = append(passes, command)
+		}
+	}
+	if len(passes) != 1 || !strings.Contains(passes[0], "-pass 2") {
+		t.Errorf("resumed job ran %q, want only pass 2", passes)
+	}
+
+	q, err = loadQueue(q.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second = q.Jobs[0], q.Jobs[1]
+	if first.State != stateDone || first.Size != 1<<20 || first.Error != "" {
+		t.Errorf("first job = %s, %d bytes, %q; want done with 1 MB", first.State, first.Size, first.Error)
+	}
+	if second.State != stateFailed || second.Error == "" {
+		t.Errorf("second job = %s, %q; want failed with its error", second.State, second.Error)
+	}
+	for _, job := range q.Jobs {
+		if _, err := os.Stat(job.Options.WorkDir); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", job.Options.WorkDir, err)
+		}
+	}
+	if _, err := os.Stat(q.path + ".work"); !os.IsNotExist(err) {
+		t.Errorf("%s.work was not removed: %v", q.path, err)
+	}
+}
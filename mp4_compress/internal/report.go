@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"phergul/mp4_compress/compress"
+)
+
+// reporter receives every event of a compression run. textReporter prints
+// the human-readable console output, jsonReporter writes one JSON object per
+// line for wrappers that drive the binary.
+type reporter interface {
+	event(e compress.Event)
+	done(res *compress.Result)
+	fail(msg string)
+}
+
+type textReporter struct {
+	mu      sync.Mutex
+	midLine bool // a progress line without a trailing newline is on screen
+}
+
+func (t *textReporter) event(e compress.Event) {
+	switch e.Kind {
+	case compress.EventPlan:
+		p := e.Plan
+		if p.Trimmed {
+			fmt.Printf("Trim: %s - %s (%.1f sec)\n", compress.FormatClock(p.Start), compress.FormatClock(p.End), p.Duration)
+		}
+		video := fmt.Sprintf("Video bitrate: %.0f kbps", p.VideoKbps)
+		if p.CRF != 0 {
+			fmt.Printf("Quality: CRF %g (%.1f sec)\n", p.CRF, p.Duration)
+			video = fmt.Sprintf("Video: CRF %g", p.CRF)
+		} else {
+			fmt.Printf("Target: %.2f MB (%.1f sec)\n", p.TargetMB, p.Duration)
+		}
+		if len(p.Audio) > 1 {
+			fmt.Printf("%s, Audio: %.0f kbps (%d tracks)\n", video, p.AudioKbps, len(p.Audio))
+		} else if len(p.Audio) == 1 {
+			fmt.Printf("%s, Audio: %.0f kbps\n", video, p.AudioKbps)
+		} else {
+			fmt.Printf("%s, Audio: none\n", video)
+		}
+		if p.Codec != compress.CodecX264 {
+			fmt.Printf("Encoder: %s\n", p.Codec)
+		}
+		if scaling := describeScaling(p); scaling != "" {
+			fmt.Printf("Output video: %s\n", scaling)
+		}
+	case compress.EventPassStart:
+		t.endLine()
+		fmt.Printf("Running pass %d...\n", e.Pass)
+	case compress.EventProgress:
+		p := e.Progress
+		etaText := "--:--"
+		if eta, ok := p.ETA(); ok {
+			etaText = formatETA(eta)
+		}
+		fmt.Printf("\rPass %d/%d: %5.1f%%  total %5.1f%%  speed %.2fx  ETA %s   ",
+			p.Pass, p.Passes, p.Fraction()*100, p.TotalFraction()*100, p.Speed, etaText)
+		t.midLine = true
+	case compress.EventPassEnd:
+		t.endLine()
+	case compress.EventPassSkip:
+		t.endLine()
+		fmt.Printf("Skipping pass %d, its stats are left from an earlier run\n", e.Pass)
+	case compress.EventRetry:
+		t.endLine()
+		fmt.Printf("Output is %.2f MB, over the %.2f MB target; retrying pass 2 at %.0f kbps (attempt %d)\n",
+			float64(e.Size)/(1024*1024), e.Plan.TargetMB, e.Plan.VideoKbps, e.Attempt)
+	case compress.EventWarning:
+		t.endLine()
+		fmt.Printf("Warning: %s\n", e.Message)
+	case compress.EventMeasure:
+		t.endLine()
+		fmt.Println("Measuring quality...")
+	case compress.EventKeep:
+		t.endLine()
+		how := "copying it unchanged"
+		if e.Action == compress.ActionRemux {
+			how = "remuxing it without re-encoding"
+		}
+		fmt.Printf("Input is already %s, within the %.2f MB target; %s (use -force to re-encode)\n",
+			formatMB(e.Info.Size), e.Plan.TargetMB, how)
+	case compress.EventAnimation:
+		t.endLine()
+		a := e.Animation
+		detail := fmt.Sprintf("%d colours", a.Colors)
+		if a.Quality > 0 {
+			detail = fmt.Sprintf("quality %d", a.Quality)
+		}
+		fmt.Printf("Attempt %d: %dpx @ %g fps, %s: %s\n", a.Attempt, a.Width, a.FPS, detail, formatMB(a.Size))
+	case compress.EventSearch:
+		s := e.Step
+		fmt.Printf("Sampled CRF %g: SSIM %.4f, about %.2f MB\n", s.CRF, s.SSIM, s.EstimatedMB)
+	}
+}
+
+func (t *textReporter) done(res *compress.Result) {
+	t.endLine()
+	switch res.Action {
+	case compress.ActionCopy:
+		fmt.Printf("Copied: %s (%.2f MB)\n", res.Output, float64(res.Size)/(1024*1024))
+		return
+	case compress.ActionRemux:
+		fmt.Printf("Remuxed: %s (%.2f MB)\n", res.Output, float64(res.Size)/(1024*1024))
+		return
+	}
+	fmt.Printf("Compression complete: %s (%.2f MB, %.0f kbps)\n", res.Output, float64(res.Size)/(1024*1024), res.Bitrate())
+	if q := res.Quality; q != nil {
+		fmt.Printf("Quality: SSIM %.4f, PSNR %s", q.SSIM, formatPSNR(q))
+		if ratio := res.Ratio(); ratio > 0 {
+			fmt.Printf(", size %.1f%% of the original", ratio*100)
+		}
+		fmt.Println()
+	}
+}
+
+func (t *textReporter) fail(msg string) {
+	t.endLine()
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+func (t *textReporter) endLine() {
+	if t.midLine {
+		fmt.Println()
+		t.midLine = false
+	}
+}
+
+func (t *textReporter) allocation(shares []budgetShare, totalMB float64, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INPUT\tDURATION\tSHARE")
+	planned := 0.0
+	for _, share := range shares {
+		switch {
+		case share.Error != "":
+			fmt.Fprintf(w, "%s\t-\tskipped: %s\n", share.Input, share.Error)
+		case share.Floored:
+			fmt.Fprintf(w, "%s\t%s\t%.2f MB (minimum)\n", share.Input, compress.FormatClock(share.Duration), share.TargetMB)
+		default:
+			fmt.Fprintf(w, "%s\t%s\t%.2f MB\n", share.Input, compress.FormatClock(share.Duration), share.TargetMB)
+		}
+		planned += share.TargetMB
+	}
+	w.Flush()
+	fmt.Printf("Planned: %.2f MB of %.2f MB budget\n", planned, totalMB)
+	if !ok {
+		fmt.Println("Warning: the videos are too long to fit the budget even at the minimum bitrate")
+	}
+	fmt.Println()
+}
+
+func (t *textReporter) budget(usedBytes int64, totalMB float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Printf("Achieved: %s of %.2f MB budget\n", formatMB(usedBytes), totalMB)
+}
+
+func (t *textReporter) split(input string, parts []compress.Part, partMB float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Printf("Splitting %s into %d parts of at most %.2f MB\n", input, len(parts), partMB)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PART\tSTART\tEND\tDURATION")
+	for i, part := range parts {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%.1f sec\n", i+1, compress.FormatClock(part.Start), compress.FormatClock(part.End), part.Duration())
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+func (t *textReporter) watching(dir, outDir string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Printf("Watching %s for videos, writing to %s\n", dir, outDir)
+}
+
+func (t *textReporter) jobStart(input, output string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Printf("Compressing %s -> %s\n", input, output)
+}
+
+func (t *textReporter) jobEvent(input string, e compress.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch e.Kind {
+	case compress.EventRetry:
+		fmt.Printf("%s: output is %.2f MB, retrying pass 2 at %.0f kbps (attempt %d)\n",
+			input, float64(e.Size)/(1024*1024), e.Plan.VideoKbps, e.Attempt)
+	case compress.EventPassSkip:
+		fmt.Printf("%s: skipping pass %d, its stats are left from an earlier run\n", input, e.Pass)
+	case compress.EventWarning:
+		fmt.Printf("%s: warning: %s\n", input, e.Message)
+	}
+}
+
+func (t *textReporter) jobEnd(row batchRow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch row.Status {
+	case "failed":
+		fmt.Printf("%s: failed: %s\n", row.Input, row.Error)
+	case "cancelled":
+		fmt.Printf("%s: cancelled\n", row.Input)
+	default:
+		fmt.Printf("%s: %s (%s -> %s)\n", row.Input, row.Status, formatMB(row.InputSize), formatMB(row.OutputSize))
+	}
+}
+
+func (t *textReporter) summary(rows []batchRow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	measured := false
+	for _, row := range rows {
+		measured = measured || row.SSIM != nil
+	}
+	if measured {
+		fmt.Fprintln(w, "INPUT\tDURATION\tORIGINAL\tOUTPUT\tBITRATE\tRATIO\tSSIM\tPSNR\tSTATUS")
+	} else {
+		fmt.Fprintln(w, "INPUT\tDURATION\tORIGINAL\tOUTPUT\tBITRATE\tRATIO\tSTATUS")
+	}
+	for _, row := range rows {
+		duration, output, bitrate, ratio := "-", "-", "-", "-"
+		if row.Output != "" {
+			duration = compress.FormatClock(row.Duration)
+			output = formatMB(row.OutputSize)
+			bitrate = fmt.Sprintf("%.0f kbps", row.Bitrate)
+			ratio = fmt.Sprintf("%.1f%%", row.Ratio()*100)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t", row.Input, duration, formatMB(row.InputSize), output, bitrate, ratio)
+		if measured {
+			ssim, psnr := "-", "-"
+			if row.SSIM != nil {
+				q := compress.Quality{SSIM: *row.SSIM, PSNR: math.Inf(1)}
+				if row.PSNR != nil {
+					q.PSNR = *row.PSNR
+				}
+				ssim, psnr = fmt.Sprintf("%.4f", q.SSIM), formatPSNR(&q)
+			}
+			fmt.Fprintf(w, "%s\t%s\t", ssim, psnr)
+		}
+		switch compress.Action(row.Action) {
+		case compress.ActionCopy:
+			fmt.Fprintf(w, "%s (copied)\n", row.Status)
+		case compress.ActionRemux:
+			fmt.Fprintf(w, "%s (remuxed)\n", row.Status)
+		default:
+			fmt.Fprintf(w, "%s\n", row.Status)
+		}
+	}
+	w.Flush()
+}
+
+// describeScaling summarises the resolution and frame rate changes of p, or
+// returns "" if the video keeps its source size and rate.
+func describeScaling(p *compress.Plan) string {
+	var parts []string
+	if p.Width > 0 {
+		parts = append(parts, fmt.Sprintf("%dx%d", p.Width, p.Height))
+	}
+	if p.FPS > 0 {
+		parts = append(parts, fmt.Sprintf("%g fps", p.FPS))
+	}
+	return strings.Join(parts, " @ ")
+}
+
+func formatPSNR(q *compress.Quality) string {
+	if !q.HasPSNR() {
+		return "identical"
+	}
+	return fmt.Sprintf("%.2f dB", q.PSNR)
+}
+
+func formatMB(size int64) string {
+	return fmt.Sprintf("%.2f MB", float64(size)/(1024*1024))
+}
+
+func formatETA(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := int(d.Hours())
+	m := int(d.Minutes()) % 60
+	s := int(d.Seconds()) % 60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d", m, s)
+}
+
+// event is a single line of --json output. Event names and field names are
+// part of the CLI's interface and should only ever be added to.
+type event struct {
+	Event        string              `json:"event"`
+	Input        string              `json:"input,omitempty"`
+	Output       string              `json:"output,omitempty"`
+	Duration     *float64            `json:"duration,omitempty"`
+	Start        *float64            `json:"start,omitempty"`
+	End          *float64            `json:"end,omitempty"`
+	TargetMB     *float64            `json:"target_mb,omitempty"`
+	VideoKbps    *float64            `json:"video_kbps,omitempty"`
+	AudioKbps    *float64            `json:"audio_kbps,omitempty"`
+	CRF          *float64            `json:"crf,omitempty"`
+	BitrateKbps  *float64            `json:"bitrate_kbps,omitempty"`
+	Ratio        *float64            `json:"ratio,omitempty"`
+	SSIM         *float64            `json:"ssim,omitempty"`
+	EstimatedMB  *float64            `json:"estimated_mb,omitempty"`
+	PSNR         *float64            `json:"psnr,omitempty"`
+	Codec        string              `json:"codec,omitempty"`
+	Width        int                 `json:"width,omitempty"`
+	Height       int                 `json:"height,omitempty"`
+	FPS          float64             `json:"fps,omitempty"`
+	Pass         int                 `json:"pass,omitempty"`
+	Passes       int                 `json:"passes,omitempty"`
+	OutTime      *float64            `json:"out_time,omitempty"`
+	Percent      *float64            `json:"percent,omitempty"`
+	TotalPercent *float64            `json:"total_percent,omitempty"`
+	Speed        *float64            `json:"speed,omitempty"`
+	ETA          *float64            `json:"eta,omitempty"`
+	Attempt      int                 `json:"attempt,omitempty"`
+	Attempts     int                 `json:"attempts,omitempty"`
+	Size         *int64              `json:"size,omitempty"`
+	Status       string              `json:"status,omitempty"`
+	Action       string              `json:"action,omitempty"`
+	Message      string              `json:"message,omitempty"`
+	Info         *compress.MediaInfo `json:"info,omitempty"`
+	Jobs         []batchRow          `json:"jobs,omitempty"`
+	Colors       int                 `json:"colors,omitempty"`
+	Quality      int                 `json:"quality,omitempty"`
+	Shares       []budgetShare       `json:"shares,omitempty"`
+	Parts        []compress.Part     `json:"parts,omitempty"`
+}
+
+type jsonReporter struct {
+	mu    *sync.Mutex
+	enc   *json.Encoder
+	input string // set on every event when following one job of a batch
+}
+
+func newJSONReporter(w io.Writer) jsonReporter {
+	return jsonReporter{mu: &sync.Mutex{}, enc: json.NewEncoder(w)}
+}
+
+func (j jsonReporter) emit(e event) {
+	if e.Input == "" {
+		e.Input = j.input
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(e)
+}
+
+func (j jsonReporter) event(e compress.Event) {
+	switch e.Kind {
+	case compress.EventProbe:
+		j.emit(event{Event: "probe", Input: e.Info.Path, Duration: &e.Info.Duration, Info: e.Info})
+	case compress.EventPlan:
+		p := *e.Plan
+		if p.Trimmed {
+			j.emit(event{Event: "trim", Start: &p.Start, End: &p.End, Duration: &p.Duration})
+		}
+		if p.CRF != 0 {
+			j.emit(event{Event: "quality", CRF: &p.CRF, Duration: &p.Duration, AudioKbps: &p.AudioKbps,
+				Codec: string(p.Codec), Width: p.Width, Height: p.Height, FPS: p.FPS})
+			break
+		}
+		j.emit(event{Event: "bitrates", TargetMB: &p.TargetMB, Duration: &p.Duration, VideoKbps: &p.VideoKbps, AudioKbps: &p.AudioKbps,
+			Codec: string(p.Codec), Width: p.Width, Height: p.Height, FPS: p.FPS})
+	case compress.EventPassStart:
+		j.emit(event{Event: "pass_start", Pass: e.Pass, Passes: e.Passes})
+	case compress.EventProgress:
+		p := e.Progress
+		percent := round2(p.Fraction() * 100)
+		totalPercent := round2(p.TotalFraction() * 100)
+		ev := event{
+			Event:        "progress",
+			Pass:         p.Pass,
+			Passes:       p.Passes,
+			OutTime:      &p.OutTime,
+			Percent:      &percent,
+			TotalPercent: &totalPercent,
+		}
+		if p.Speed > 0 {
+			ev.Speed = &p.Speed
+		}
+		if eta, ok := p.ETA(); ok {
+			seconds := math.Round(eta.Seconds())
+			ev.ETA = &seconds
+		}
+		j.emit(ev)
+	case compress.EventPassEnd:
+		j.emit(event{Event: "pass_end", Pass: e.Pass, Passes: e.Passes})
+	case compress.EventPassSkip:
+		j.emit(event{Event: "pass_skip", Pass: e.Pass, Passes: e.Passes})
+	case compress.EventRetry:
+		j.emit(event{Event: "retry", Attempt: e.Attempt, Size: &e.Size, TargetMB: &e.Plan.TargetMB, VideoKbps: &e.Plan.VideoKbps})
+	case compress.EventWarning:
+		j.emit(event{Event: "warning", Message: e.Message})
+	case compress.EventMeasure:
+		j.emit(event{Event: "measure_start"})
+	case compress.EventKeep:
+		j.emit(event{Event: "keep", Action: string(e.Action), Size: &e.Info.Size, TargetMB: &e.Plan.TargetMB})
+	case compress.EventAnimation:
+		a := e.Animation
+		j.emit(event{Event: "animation", Attempt: a.Attempt, Width: a.Width, FPS: a.FPS, Colors: a.Colors, Quality: a.Quality, Size: &a.Size})
+	case compress.EventSearch:
+		s := e.Step
+		j.emit(event{Event: "search", CRF: &s.CRF, SSIM: &s.SSIM, EstimatedMB: &s.EstimatedMB})
+	}
+}
+
+func (j jsonReporter) done(res *compress.Result) {
+	bitrate := math.Round(res.Bitrate())
+	e := event{Event: "done", Output: res.Output, Size: &res.Size, BitrateKbps: &bitrate, Attempts: res.Attempts, Action: string(res.Action)}
+	if ratio := res.Ratio(); ratio > 0 {
+		ratio = math.Round(ratio*10000) / 10000
+		e.Ratio = &ratio
+	}
+	if q := res.Quality; q != nil {
+		e.SSIM = &q.SSIM
+		// JSON has no infinity; identical frames leave psnr out.
+		if q.HasPSNR() {
+			e.PSNR = &q.PSNR
+		}
+	}
+	j.emit(e)
+}
+
+func (j jsonReporter) fail(msg string) {
+	j.emit(event{Event: "error", Message: msg})
+}
+
+func (j jsonReporter) allocation(shares []budgetShare, totalMB float64, ok bool) {
+	e := event{Event: "allocation", TargetMB: &totalMB, Shares: shares}
+	if !ok {
+		e.Message = "the videos are too long to fit the budget even at the minimum bitrate"
+	}
+	j.emit(e)
+}
+
+func (j jsonReporter) budget(usedBytes int64, totalMB float64) {
+	j.emit(event{Event: "budget", TargetMB: &totalMB, Size: &usedBytes})
+}
+
+func (j jsonReporter) split(input string, parts []compress.Part, partMB float64) {
+	j.emit(event{Event: "split", Input: input, TargetMB: &partMB, Parts: parts})
+}
+
+func (j jsonReporter) watching(dir, outDir string) {
+	j.emit(event{Event: "watch", Input: dir, Output: outDir})
+}
+
+func (j jsonReporter) jobStart(input, output string) {
+	j.emit(event{Event: "job_start", Input: input, Output: output})
+}
+
+func (j jsonReporter) jobEvent(input string, e compress.Event) {
+	j.input = input
+	j.event(e)
+}
+
+func (j jsonReporter) jobEnd(row batchRow) {
+	e := event{Event: "job_end", Input: row.Input, Output: row.Output, Status: row.Status, Message: row.Error}
+	if row.Output != "" {
+		e.Size = &row.OutputSize
+	}
+	j.emit(e)
+}
+
+func (j jsonReporter) summary(rows []batchRow) {
+	j.emit(event{Event: "summary", Jobs: rows})
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
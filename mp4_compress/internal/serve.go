@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"phergul/mp4_compress/compress"
+)
+
+const (
+	// maxUploadMemory is how much of a multipart upload is held in memory
+	// before the rest goes to a temporary file.
+	maxUploadMemory = 32 << 20
+	// maxJSONBody limits the body of a JSON job request.
+	maxJSONBody = 1 << 20
+	// maxJobEvents is how many events a job keeps for its streams. Beyond
+	// it the oldest progress events are dropped, and then the oldest events.
+	maxJobEvents = 1000
+)
+
+// jobRequest is the body of POST /jobs. With a multipart upload the same
+// names are form fields and the video is the "file" part instead of Input.
+type jobRequest struct {
+	Input    string  `json:"input"`
+	Output   string  `json:"output"`
+	TargetMB float64 `json:"target_mb"`
+	CRF      float64 `json:"crf"`
+	Start    string  `json:"start"`
+	End      string  `json:"end"`
+	Duration string  `json:"duration"`
+	Codec    string  `json:"codec"`
+
+	upload bool // Input was uploaded with the request
+}
+
+// serveJob is one job submitted to the server.
+type serveJob struct {
+	id     string
+	opts   compress.Options
+	upload bool // opts.Input was uploaded and is removed when the job ends
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	view    jobView
+	events  []jobEvent    // the job's --json event lines, in order
+	written int           // how many events were written, including dropped ones
+	changed chan struct{} // closed and replaced whenever events or view change
+}
+
+// jobEvent is one --json event line of a job and its place among all the
+// job's events.
+type jobEvent struct {
+	seq      int
+	line     []byte
+	progress bool
+}
+
+// jobView is how a job is shown by the API.
+type jobView struct {
+	ID       string    `json:"id"`
+	Input    string    `json:"input"`
+	Output   string    `json:"output"`
+	TargetMB float64   `json:"target_mb,omitempty"`
+	CRF      float64   `json:"crf,omitempty"`
+	Status   string    `json:"status"` // queued, running, done, failed or cancelled
+	Percent  float64   `json:"percent"`
+	Size     int64     `json:"size,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished,omitzero"`
+}
+
+// Write appends one event line; the jobs' jsonReporter writes every event
+// with a single call.
+func (j *serveJob) Write(p []byte) (int, error) {
+	line := bytes.TrimSpace(bytes.Clone(p))
+	e := jobEvent{line: line, progress: bytes.HasPrefix(line, []byte(`{"event":"progress"`))}
+	j.update(func(*jobView) {
+		e.seq = j.written
+		j.written++
+		j.events = append(j.events, e)
+		if len(j.events) > maxJobEvents {
+			i := slices.IndexFunc(j.events, func(e jobEvent) bool { return e.progress })
+			if i < 0 {
+				i = 0
+			}
+			j.events = slices.Delete(j.events, i, i+1)
+		}
+	})
+	return len(p), nil
+}
+
+// update changes the job under its lock and wakes up its event streams.
+func (j *serveJob) update(f func(v *jobView)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(&j.view)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// snapshot returns the current view of the job, the events kept from the
+// one numbered from on, and a channel that is closed on the next change.
+func (j *serveJob) snapshot(from int) (jobView, []jobEvent, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	i, _ := slices.BinarySearchFunc(j.events, from, func(e jobEvent, seq int) int { return e.seq - seq })
+	return j.view, slices.Clone(j.events[i:]), j.changed
+}
+
+// current returns the current view of the job.
+func (j *serveJob) current() jobView {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.view
+}
+
+func (v jobView) finished() bool {
+	return v.Status == "done" || v.Status == "failed" || v.Status == "cancelled"
+}
+
+// jobServer queues submitted jobs and runs them with a fixed number of
+// workers.
+type jobServer struct {
+	base      compress.Options
+	dataDir   string
+	queue     chan *serveJob
+	ctx       context.Context
+	keep      int   // finished jobs kept for the API, newest first
+	maxUpload int64 // bytes a multipart request may have
+
+	mu     sync.Mutex
+	jobs   map[string]*serveJob
+	order  []string
+	nextID int
+}
+
+// runServe implements `mp4_compress serve [options]`.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "Address to listen on; the API has no authentication and only answers requests for localhost")
+	workers := fs.Int("jobs", 1, "Number of videos to compress at once")
+	queueSize := fs.Int("queue", 16, "Number of jobs that can wait for a worker before submissions are refused")
+	keep := fs.Int("keep", 100, "Number of finished jobs the API keeps; older ones are forgotten, but their outputs stay in the data directory")
+	maxUpload := fs.Float64("max-upload", 4096, "Largest upload accepted, in MB")
+	dataDir := fs.String("dir", "", "Directory for uploads and outputs; a job's output path is relative to it (default: a temporary directory removed on exit)")
+	encode := addEncodeFlags(fs)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s serve [options]\n", os.Args[0])
+		fs.PrintDefaults()
+		fmt.Println(`
+Endpoints:
+  POST   /jobs              submit a job: application/json {"input", "target_mb" or "crf", "start",
+                            "end", "duration", "codec", "output"} or a multipart upload with a
+                            "file" part; "output" is a file name in the data directory
+  GET    /jobs              list jobs
+  GET    /jobs/{id}         show a job
+  GET    /jobs/{id}/events  stream the job's --json events as Server-Sent Events
+  DELETE /jobs/{id}         cancel a job
+  GET    /jobs/{id}/output  download the result`)
+	}
+	fs.Parse(args)
+
+	r := &textReporter{}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *workers < 1 || *queueSize < 0 || *keep < 0 {
+		fatal(r, "-jobs must be at least 1, and -queue and -keep not negative")
+	}
+	if !validMB(*maxUpload) || *maxUpload == 0 {
+		fatal(r, "-max-upload must be greater than 0 MB")
+	}
+	base, err := encode.options()
+	if err != nil {
+		fatal(r, "%v", err)
+	}
+	if *dataDir == "" {
+		if *dataDir, err = os.MkdirTemp("", "mp4_compress-serve-*"); err != nil {
+			fatal(r, "Cannot create data directory: %v", err)
+		}
+		defer os.RemoveAll(*dataDir)
+	} else if err := os.MkdirAll(*dataDir, 0755); err != nil {
+		fatal(r, "Cannot create data directory: %v", err)
+	}
+
+	// A signal cancels every job and closes the event streams, so Shutdown
+	// does not wait on them.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := &jobServer{
+		base:      base,
+		dataDir:   *dataDir,
+		queue:     make(chan *serveJob, *queueSize),
+		ctx:       ctx,
+		keep:      *keep,
+		maxUpload: int64(*maxUpload * 1024 * 1024),
+		jobs:      make(map[string]*serveJob),
+	}
+	var wg sync.WaitGroup
+	for range *workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work()
+		}()
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fatal(r, "Cannot listen on %s: %v", *addr, err)
+	}
+	srv := &http.Server{
+		Handler:           s.handler(),
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("Listening on http://%s, data in %s\n", listener.Addr(), *dataDir)
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal(r, "Server failed: %v", err)
+	}
+	wg.Wait()
+	s.discardQueued()
+}
+
+// handler routes the API. Requests must name localhost, and come from a
+// page on the server itself if they come from a browser at all, so other
+// web pages cannot reach the API, either directly or by DNS rebinding.
+func (s *jobServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.submit)
+	mux.HandleFunc("GET /jobs", s.list)
+	mux.HandleFunc("GET /jobs/{id}", s.withJob(s.show))
+	mux.HandleFunc("GET /jobs/{id}/events", s.withJob(s.stream))
+	mux.HandleFunc("DELETE /jobs/{id}", s.withJob(s.cancel))
+	mux.HandleFunc("GET /jobs/{id}/output", s.withJob(s.download))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopbackHost(r.Host) {
+			writeError(w, http.StatusForbidden, errors.New("requests must be made to localhost"))
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				writeError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether host, with or without a port, is localhost
+// or a loopback address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// work runs queued jobs until the server stops.
+func (s *jobServer) work() {
+	for {
+		var job *serveJob
+		select {
+		case <-s.ctx.Done():
+			return
+		case job = <-s.queue:
+		}
+		if job.ctx.Err() != nil {
+			job.discard() // cancelled while queued
+			continue
+		}
+		job.update(func(v *jobView) { v.Status = "running" })
+		fmt.Printf("Job %s: compressing %s -> %s\n", job.id, job.opts.Input, job.opts.Output)
+
+		r := newJSONReporter(job)
+		opts := job.opts
+		opts.OnEvent = func(e compress.Event) {
+			r.event(e)
+			if e.Kind == compress.EventProgress {
+				percent := round2(e.Progress.TotalFraction() * 100)
+				job.update(func(v *jobView) { v.Percent = percent })
+			}
+		}
+		res, err := compress.Compress(job.ctx, opts)
+		switch {
+		case compress.IsCanceled(err):
+			r.fail("Compression cancelled")
+		case err != nil:
+			r.fail(fmt.Sprintf("Compression failed: %v", err))
+		default:
+			r.done(res)
+		}
+		job.update(func(v *jobView) {
+			v.Finished = time.Now()
+			switch {
+			case compress.IsCanceled(err):
+				v.Status = "cancelled"
+			case err != nil:
+				v.Status, v.Error = "failed", err.Error()
+			default:
+				v.Status, v.Percent, v.Size, v.Output = "done", 100, res.Size, res.Output
+			}
+		})
+		job.discard()
+		view := job.current()
+		fmt.Printf("Job %s: %s\n", job.id, view.Status)
+	}
+}
+
+// discardQueued cancels the jobs still waiting for a worker when the server
+// stops.
+func (s *jobServer) discardQueued() {
+	for {
+		select {
+		case job := <-s.queue:
+			job.discard()
+		default:
+			return
+		}
+	}
+}
+
+// discard releases the job's context and removes its upload once the job
+// can no longer run.
+func (j *serveJob) discard() {
+	j.cancel()
+	if j.upload {
+		os.Remove(j.opts.Input)
+	}
+}
+
+func (s *jobServer) submit(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.mu.Unlock()
+
+	req, err := s.parseRequest(w, r, id)
+	if req.upload {
+		// The upload is only kept once the job is queued.
+		defer func() {
+			if err != nil {
+				os.Remove(req.Input)
+			}
+		}()
+	}
+	if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	opts, err := s.jobOptions(r.Context(), req, id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	job := &serveJob{
+		id:      id,
+		opts:    opts,
+		upload:  req.upload,
+		ctx:     ctx,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+		view: jobView{
+			ID:       id,
+			Input:    opts.Input,
+			Output:   opts.Output,
+			TargetMB: opts.TargetMB,
+			CRF:      opts.CRF,
+			Status:   "queued",
+			Created:  time.Now(),
+		},
+	}
+	select {
+	case s.queue <- job:
+	default:
+		cancel()
+		err = errors.New("the queue is full, try again later")
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	s.mu.Lock()
+	s.jobs[id] = job
+	s.order = append(s.order, id)
+	s.forget()
+	s.mu.Unlock()
+
+	view := job.current()
+	w.Header().Set("Location", "/jobs/"+id)
+	writeJSON(w, http.StatusAccepted, view)
+}
+
+// forget removes the oldest finished jobs beyond s.keep. s.mu must be held.
+func (s *jobServer) forget() {
+	finished := 0
+	for i := len(s.order) - 1; i >= 0; i-- {
+		id := s.order[i]
+		if !s.jobs[id].current().finished() {
+			continue
+		}
+		if finished++; finished > s.keep {
+			delete(s.jobs, id)
+			s.order = slices.Delete(s.order, i, i+1)
+		}
+	}
+}
+
+// parseRequest reads a JSON or multipart job request, refusing bodies over
+// maxJSONBody and s.maxUpload. An uploaded file is saved in the data
+// directory and becomes the input.
+func (s *jobServer) parseRequest(w http.ResponseWriter, r *http.Request, id string) (jobRequest, error) {
+	var req jobRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		r.Body = http.MaxBytesReader(w, r.Body, maxJSONBody)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, fmt.Errorf("invalid JSON body: %w", err)
+		}
+		if req.Input == "" {
+			return req, errors.New("input is required")
+		}
+		return req, nil
+	case "multipart/form-data":
+	default:
+		return req, errors.New("the body must be application/json or multipart/form-data")
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		return req, fmt.Errorf("invalid upload: %w", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+	var err error
+	for name, value := range map[string]*float64{"target_mb": &req.TargetMB, "crf": &req.CRF} {
+		if v := r.FormValue(name); v != "" {
+			if *value, err = strconv.ParseFloat(v, 64); err != nil {
+				return req, fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+	req.Start, req.End, req.Duration = r.FormValue("start"), r.FormValue("end"), r.FormValue("duration")
+	req.Codec, req.Output = r.FormValue("codec"), r.FormValue("output")
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return req, fmt.Errorf("file is required: %v", err)
+	}
+	defer file.Close()
+	req.Input = filepath.Join(s.dataDir, id+"_"+filepath.Base(header.Filename))
+	out, err := os.Create(req.Input)
+	if err != nil {
+		return req, err
+	}
+	req.upload = true
+	if _, err := io.Copy(out, file); err != nil {
+		out.Close()
+		return req, fmt.Errorf("saving upload: %v", err)
+	}
+	return req, out.Close()
+}
+
+// jobOptions turns a request into compress options on top of the server's.
+// Jobs without an output path write into the data directory, named after
+// the codec they will really use.
+func (s *jobServer) jobOptions(ctx context.Context, req jobRequest, id string) (compress.Options, error) {
+	opts := s.base
+	opts.Input, opts.Output = req.Input, req.Output
+	opts.TargetMB, opts.CRF = req.TargetMB, req.CRF
+	if opts.TargetMB == 0 && opts.CRF == 0 {
+		return opts, errors.New("target_mb or crf is required")
+	}
+	if opts.TargetMB != 0 && opts.CRF != 0 {
+		return opts, errors.New("target_mb and crf cannot be used together")
+	}
+
+	var err error
+	if req.Codec != "" {
+		if opts.Codec, err = compress.ParseCodec(req.Codec); err != nil {
+			return opts, fmt.Errorf("invalid codec: %v", err)
+		}
+	}
+	if opts.Start, err = parseTimeFlag(req.Start); err != nil {
+		return opts, fmt.Errorf("invalid start: %v", err)
+	}
+	if opts.End, err = parseTimeFlag(req.End); err != nil {
+		return opts, fmt.Errorf("invalid end: %v", err)
+	}
+	if opts.Duration, err = parseTimeFlag(req.Duration); err != nil {
+		return opts, fmt.Errorf("invalid duration: %v", err)
+	}
+
+	if opts.Input, err = filepath.Abs(opts.Input); err != nil {
+		return opts, err
+	}
+	switch {
+	case opts.Output == "":
+		// Uploads already carry the job ID in their name.
+		codec, err := compress.ResolveCodec(ctx, opts)
+		if err != nil {
+			return opts, err
+		}
+		name := filepath.Base(batchOutput(opts.Input, "", codec.Ext()))
+		opts.Output = filepath.Join(s.dataDir, id+"_"+strings.TrimPrefix(name, id+"_"))
+	case filepath.IsLocal(opts.Output):
+		opts.Output = filepath.Join(s.dataDir, opts.Output)
+	default:
+		return opts, errors.New("output must be a file name inside the data directory")
+	}
+	if opts.Output, err = filepath.Abs(opts.Output); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func (s *jobServer) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := make([]*serveJob, len(s.order))
+	for i, id := range s.order {
+		jobs[i] = s.jobs[id]
+	}
+	s.mu.Unlock()
+
+	views := make([]jobView, len(jobs))
+	for i, job := range jobs {
+		views[i] = job.current()
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// withJob looks up the job named in the path for h.
+func (s *jobServer) withJob(h func(http.ResponseWriter, *http.Request, *serveJob)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		job, ok := s.jobs[r.PathValue("id")]
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("no such job"))
+			return
+		}
+		h(w, r, job)
+	}
+}
+
+func (s *jobServer) show(w http.ResponseWriter, r *http.Request, job *serveJob) {
+	view := job.current()
+	writeJSON(w, http.StatusOK, view)
+}
+
+// stream sends the job's events so far and then every new one as
+// Server-Sent Events, ending when the job has finished.
+func (s *jobServer) stream(w http.ResponseWriter, r *http.Request, job *serveJob) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	sent := 0
+	for {
+		view, events, changed := job.snapshot(sent)
+		for _, e := range events {
+			fmt.Fprintf(w, "data: %s\n\n", e.line)
+			sent = e.seq + 1
+		}
+		flusher.Flush()
+		if view.finished() {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *jobServer) cancel(w http.ResponseWriter, r *http.Request, job *serveJob) {
+	job.update(func(v *jobView) {
+		if v.Status == "queued" {
+			v.Status, v.Finished = "cancelled", time.Now()
+		}
+	})
+	job.cancel()
+	view := job.current()
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (s *jobServer) download(w http.ResponseWriter, r *http.Request, job *serveJob) {
+	view := job.current()
+	if view.Status != "done" {
+		writeError(w, http.StatusConflict, fmt.Errorf("job is %s", view.Status))
+		return
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(view.Output)}))
+	http.ServeFile(w, r, view.Output)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"phergul/mp4_compress/compress"
+	"phergul/mp4_compress/compress/compresstest"
+)
+
+// newTestServer starts a jobServer with one worker whose ffmpeg and ffprobe
+// are the fake, keeping two finished jobs and taking uploads of up to 4 KiB,
+// and returns it with its HTTP server and an input file.
+func newTestServer(t *testing.T, script compresstest.Script) (*jobServer, *httptest.Server, string) {
+	t.Helper()
+	runner, input := compresstest.New(t, script)
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &jobServer{
+		base:      compress.Options{Runner: runner, Force: true, TempDir: t.TempDir()},
+		dataDir:   t.TempDir(),
+		queue:     make(chan *serveJob, 4),
+		ctx:       ctx,
+		keep:      2,
+		maxUpload: 4 << 10,
+		jobs:      make(map[string]*serveJob),
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.work()
+	}()
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+		wg.Wait()
+	})
+	return s, srv, input
+}
+
+// waitForJob follows the job's event stream until it ends and returns the
+// job as the API then shows it.
+func waitForJob(t *testing.T, srv *httptest.Server, location string) jobView {
+	t.Helper()
+	resp, err := http.Get(srv.URL + location + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stream ends when the job has finished.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	resp, err = http.Get(srv.URL + location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var view jobView
+	if err := json.NewDecoder(resp.Body).Decode(&view); err != nil {
+		t.Fatal(err)
+	}
+	return view
+}
+
+func TestServeJob(t *testing.T) {
+	_, srv, input := newTestServer(t, compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 100})
+
+	body, _ := json.Marshal(map[string]any{"input": input, "target_mb": 2, "output": "out.mp4"})
+	resp, err := http.Post(srv.URL+"/jobs", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST /jobs = %s, want %d", resp.Status, http.StatusAccepted)
+	}
+
+	view := waitForJob(t, srv, resp.Header.Get("Location"))
+	if view.Status != "done" || view.Size != 100<<10 || filepath.Base(view.Output) != "out.mp4" {
+		t.Fatalf("job = %+v, want a done job with a 100 KiB out.mp4", view)
+	}
+	resp, err = http.Get(srv.URL + "/jobs/" + view.ID + "/output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(data) != 100<<10 {
+		t.Errorf("GET output = %s with %d bytes, want %d bytes", resp.Status, len(data), 100<<10)
+	}
+}
+
+func TestServeUpload(t *testing.T) {
+	s, srv, _ := newTestServer(t, compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 100})
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("target_mb", "2")
+	part, _ := mw.CreateFormFile("file", "clip.mp4")
+	part.Write([]byte("not really a video"))
+	mw.Close()
+	resp, err := http.Post(srv.URL+"/jobs", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST /jobs = %s, want %d", resp.Status, http.StatusAccepted)
+	}
+
+	view := waitForJob(t, srv, resp.Header.Get("Location"))
+	if view.Status != "done" {
+		t.Fatalf("job = %+v, want done", view)
+	}
+	if _, err := os.Stat(view.Input); !os.IsNotExist(err) {
+		t.Errorf("upload %s was kept after the job: %v", view.Input, err)
+	}
+	if filepath.Dir(view.Output) != s.dataDir {
+		t.Errorf("output %s is not in the data directory %s", view.Output, s.dataDir)
+	}
+}
+
+func TestServeRejects(t *testing.T) {
+	s, srv, input := newTestServer(t, compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 100})
+	job := func(output string) string {
+		body, _ := json.Marshal(map[string]any{"input": input, "target_mb": 2, "output": output})
+		return string(body)
+	}
+	var upload bytes.Buffer
+	mw := multipart.NewWriter(&upload)
+	mw.WriteField("target_mb", "2")
+	part, _ := mw.CreateFormFile("file", "clip.mp4")
+	part.Write(make([]byte, 8<<10))
+	mw.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		host        string
+		origin      string
+		status      int
+	}{
+		{name: "a body that is not JSON", contentType: "text/plain", body: job("out.mp4"), status: http.StatusBadRequest},
+		{name: "no content type", body: job("out.mp4"), status: http.StatusBadRequest},
+		{name: "another origin", contentType: "application/json", body: job("out.mp4"), origin: "https://example.com", status: http.StatusForbidden},
+		{name: "another host", contentType: "application/json", body: job("out.mp4"), host: "rebound.example.com", status: http.StatusForbidden},
+		{name: "output outside the data directory", contentType: "application/json", body: job("../out.mp4"), status: http.StatusBadRequest},
+		{name: "absolute output", contentType: "application/json", body: job(filepath.Join(filepath.Dir(input), "out.mp4")), status: http.StatusBadRequest},
+		{name: "upload over the limit", contentType: mw.FormDataContentType(), body: upload.String(), status: http.StatusRequestEntityTooLarge},
+		{name: "JSON body over the limit", contentType: "application/json", body: strings.Repeat(" ", maxJSONBody+1), status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/jobs", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("POST /jobs = %s, want %d", resp.Status, tt.status)
+			}
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.jobs) != 0 {
+		t.Errorf("%d jobs were accepted, want none", len(s.jobs))
+	}
+	if entries, _ := os.ReadDir(s.dataDir); len(entries) != 0 {
+		t.Errorf("rejected requests left %d files in the data directory", len(entries))
+	}
+}
+
+func TestServeForgetsFinishedJobs(t *testing.T) {
+	_, srv, input := newTestServer(t, compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 100})
+
+	var locations []string
+	for i := range 4 {
+		body, _ := json.Marshal(map[string]any{"input": input, "target_mb": 2, "output": fmt.Sprintf("out%d.mp4", i)})
+		resp, err := http.Post(srv.URL+"/jobs", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		locations = append(locations, resp.Header.Get("Location"))
+		waitForJob(t, srv, locations[i])
+	}
+
+	// Submitting the fourth job forgot the first; the server keeps two
+	// finished jobs besides the new one.
+	for i, location := range locations {
+		resp, err := http.Get(srv.URL + location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		want := http.StatusOK
+		if i == 0 {
+			want = http.StatusNotFound
+		}
+		if resp.StatusCode != want {
+			t.Errorf("GET %s = %s, want %d", location, resp.Status, want)
+		}
+	}
+}
+
+func TestServeJobEvents(t *testing.T) {
+	job := &serveJob{changed: make(chan struct{})}
+	fmt.Fprintln(job, `{"event":"probe"}`)
+	for i := range maxJobEvents {
+		fmt.Fprintf(job, `{"event":"progress","out_time":%d}`+"\n", i)
+	}
+	fmt.Fprintln(job, `{"event":"done"}`)
+
+	// The oldest progress events make way for the newest events.
+	_, events, _ := job.snapshot(0)
+	if len(events) != maxJobEvents {
+		t.Fatalf("kept %d events, want %d", len(events), maxJobEvents)
+	}
+	if first, last := string(events[0].line), string(events[len(events)-1].line); first != `{"event":"probe"}` || last != `{"event":"done"}` {
+		t.Errorf("kept events from %s to %s, want the probe and done events", first, last)
+	}
+	if got := string(events[1].line); got != `{"event":"progress","out_time":2}` {
+		t.Errorf("oldest progress event kept is %s, want out_time 2", got)
+	}
+
+	// A stream that has seen an event gets only the later ones.
+	if _, events, _ := job.snapshot(events[len(events)-2].seq + 1); len(events) != 1 || string(events[0].line) != `{"event":"done"}` {
+		t.Errorf("events after the last progress = %d, want only done", len(events))
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"phergul/mp4_compress/compress"
+)
+
+// splitManifest is written next to the parts of a split input so they can
+// be put back in order.
+type splitManifest struct {
+	Input  string      `json:"input"`
+	PartMB float64     `json:"part_mb"`
+	Parts  []splitPart `json:"parts"`
+}
+
+type splitPart struct {
+	File   string  `json:"file"`
+	Start  float64 `json:"start"`
+	End    float64 `json:"end"`
+	Size   int64   `json:"size,omitempty"`
+	Status string  `json:"status"`
+}
+
+// runSplit cuts input into parts of at most partMB each and compresses them
+// into outDir, or next to the input when outDir is empty, using base for
+// everything but the paths, range and target. It writes a manifest of the
+// parts and returns false if any part failed.
+func runSplit(ctx context.Context, r batchReporter, base compress.Options, input, outDir string, partMB float64, workers int) (bool, error) {
+	info, err := compress.Probe(ctx, base.Runner, input)
+	if err != nil {
+		return false, err
+	}
+	// Cuts fall back to exact times without keyframes; the parts are
+	// re-encoded either way.
+	keyframes, err := compress.Keyframes(ctx, base.Runner, input)
+	if compress.IsCanceled(err) {
+		return false, err
+	}
+	if err != nil {
+		r.jobEvent(filepath.Base(input), compress.Event{Kind: compress.EventWarning, Message: fmt.Sprintf(
+			"cannot read keyframes, cutting at exact times instead: %v", err)})
+	}
+	parts, err := compress.SplitParts(base, info, partMB, keyframes)
+	if err != nil {
+		return false, err
+	}
+	codec, err := compress.ResolveCodec(ctx, base)
+	if err != nil {
+		return false, err
+	}
+	if outDir == "" {
+		outDir = filepath.Dir(input)
+	} else if err := os.MkdirAll(outDir, 0755); err != nil {
+		return false, fmt.Errorf("cannot create output directory: %v", err)
+	}
+
+	manifest := splitManifest{Input: input, PartMB: partMB, Parts: make([]splitPart, len(parts))}
+	jobs := make([]compress.Options, len(parts))
+	labels := make([]string, len(parts))
+	for i, part := range parts {
+		output := splitOutput(input, outDir, codec.Ext(), i, len(parts))
+		label := fmt.Sprintf("%s [%s - %s]", filepath.Base(input), compress.FormatClock(part.Start), compress.FormatClock(part.End))
+		manifest.Parts[i] = splitPart{File: filepath.Base(output), Start: part.Start, End: part.End}
+		labels[i] = label
+
+		jobs[i] = base
+		jobs[i].Input, jobs[i].Output, jobs[i].Info = input, output, info
+		jobs[i].Start, jobs[i].End, jobs[i].Duration = part.Start, part.End, 0
+		jobs[i].TargetMB = partMB
+		started := false
+		jobs[i].OnEvent = func(e compress.Event) {
+			if !started {
+				started = true
+				r.jobStart(label, output)
+			}
+			r.jobEvent(label, e)
+		}
+	}
+	r.split(input, parts, partMB)
+
+	rows := make([]batchRow, len(jobs))
+	compress.CompressAll(ctx, jobs, workers, func(i int, jr compress.JobResult) {
+		rows[i] = summarize(jr)
+		rows[i].Input = labels[i]
+		rows[i].InputSize = int64(float64(info.Size) * parts[i].Duration() / info.Duration)
+		manifest.Parts[i].Size = rows[i].OutputSize
+		manifest.Parts[i].Status = rows[i].Status
+		r.jobEnd(rows[i])
+	})
+	r.summary(rows)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	name := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input)) + "_parts.json"
+	if err := os.WriteFile(filepath.Join(outDir, name), append(data, '\n'), 0644); err != nil {
+		return false, fmt.Errorf("writing manifest: %v", err)
+	}
+
+	for _, row := range rows {
+		if row.Status != "ok" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// splitOutput names part i of n as <name>_part01.mp4, with as many digits as
+// n needs.
+func splitOutput(input, outDir, ext string, i, n int) string {
+	digits := max(2, len(fmt.Sprint(n)))
+	name := fmt.Sprintf("%s_part%0*d%s", strings.TrimSuffix(filepath.Base(input), filepath.Ext(input)), digits, i+1, ext)
+	return filepath.Join(outDir, name)
+}
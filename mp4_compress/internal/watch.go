@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"phergul/mp4_compress/compress"
+)
+
+// watchStateFile is the name of the state file kept in the watched folder.
+// It starts with a dot so the folder scan skips it.
+const watchStateFile = ".mp4_compress_watch.json"
+
+// watchState records the files a watcher has finished with, so a restarted
+// watcher does not compress them again.
+type watchState struct {
+	path  string
+	Files map[string]watchEntry `json:"files"`
+}
+
+// watchEntry is a file the watcher has finished with, keyed by its name.
+// Size and ModTime tell it apart from a new file dropped under the same name.
+type watchEntry struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Status   string    `json:"status"`
+	Output   string    `json:"output,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Finished time.Time `json:"finished"`
+}
+
+// pendingFile is a file seen in the watched folder that has not been
+// compressed yet.
+type pendingFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // when size and modTime last changed
+}
+
+// runWatch implements `mp4_compress watch [options] <dir>`: it polls dir for
+// videos, compresses each once it has stopped growing and then moves the
+// original into dir/done or dir/failed.
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "Emit one JSON object per event on stdout instead of human-readable output")
+	target := fs.Float64("target", 0, "Target size in MB for every video")
+	crf := fs.Float64("crf", 0, "Constant-quality mode: compress every video at this CRF instead of a target size")
+	outDir := fs.String("out-dir", "", "Directory for the outputs (default: <dir>/compressed)")
+	interval := fs.Duration("interval", 5*time.Second, "How often to look for new videos")
+	settle := fs.Duration("settle", 10*time.Second, "How long a video must stay the same size before it is compressed")
+	encode := addEncodeFlags(fs)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s watch -target <MB> [options] <dir>\n", os.Args[0])
+		fmt.Printf("       %s watch -crf <N> [options] <dir>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	text := &textReporter{}
+	var r reporter = text
+	var br batchReporter = text
+	if *jsonOutput {
+		j := newJSONReporter(os.Stdout)
+		r, br = j, j
+	}
+
+	if fs.NArg() != 1 || (*target == 0 && *crf == 0) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *target != 0 && *crf != 0 {
+		fatal(r, "-target and -crf cannot be used together")
+	}
+	if !validMB(*target) {
+		fatal(r, "-target must be greater than 0 MB")
+	}
+	if *interval <= 0 || *settle < 0 {
+		fatal(r, "-interval must be positive and -settle not negative")
+	}
+	opts, err := encode.options()
+	if err != nil {
+		fatal(r, "%v", err)
+	}
+	opts.TargetMB, opts.CRF = *target, *crf
+
+	dir := fs.Arg(0)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		fatal(r, "Cannot watch %s: not a directory", dir)
+	}
+	if *outDir == "" {
+		*outDir = filepath.Join(dir, "compressed")
+	}
+	// Outputs written into the watched folder would be picked up and
+	// compressed again, endlessly.
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		fatal(r, "Cannot watch %s: %v", dir, err)
+	}
+	if absOut, err := filepath.Abs(*outDir); err != nil || absOut == absDir {
+		fatal(r, "-out-dir must not be the watched folder")
+	}
+	for _, sub := range []string{*outDir, filepath.Join(dir, "done"), filepath.Join(dir, "failed")} {
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			fatal(r, "Cannot create %s: %v", sub, err)
+		}
+	}
+	state, err := loadWatchState(filepath.Join(dir, watchStateFile))
+	if err != nil {
+		fatal(r, "Cannot read watch state: %v", err)
+	}
+
+	// A signal stops the watcher; a video being compressed is left in the
+	// folder and compressed again by the next run.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Outputs are named after the codec the jobs will really use, which a
+	// fallback to libx264 can put in a different container.
+	codec, err := compress.ResolveCodec(ctx, opts)
+	if err != nil {
+		fatal(r, "%v", err)
+	}
+
+	br.watching(dir, *outDir)
+	pending := make(map[string]*pendingFile)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		for _, name := range scanWatchDir(r, dir, pending, *settle) {
+			if err := watchFile(ctx, br, opts, state, dir, name, *outDir, codec.Ext()); err != nil {
+				r.fail(fmt.Sprintf("%s: %v", name, err))
+			}
+			delete(pending, name)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scanWatchDir updates pending from the videos in dir and returns the names
+// of those that have kept their size for settle, oldest first.
+func scanWatchDir(r reporter, dir string, pending map[string]*pendingFile, settle time.Duration) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		r.fail(fmt.Sprintf("Cannot read %s: %v", dir, err))
+		return nil
+	}
+	now := time.Now()
+	seen := make(map[string]bool)
+	var ready []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !slices.Contains(videoExts, strings.ToLower(filepath.Ext(name))) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		seen[name] = true
+		p, ok := pending[name]
+		if !ok || p.size != info.Size() || !p.modTime.Equal(info.ModTime()) {
+			pending[name] = &pendingFile{size: info.Size(), modTime: info.ModTime(), since: now}
+			if settle > 0 {
+				continue
+			}
+			p = pending[name]
+		}
+		if now.Sub(p.since) >= settle {
+			ready = append(ready, name)
+		}
+	}
+	for name := range pending {
+		if !seen[name] {
+			delete(pending, name)
+		}
+	}
+	slices.SortFunc(ready, func(a, b string) int {
+		return pending[a].modTime.Compare(pending[b].modTime)
+	})
+	return ready
+}
+
+// watchFile compresses dir/name into outDir with the extension ext, unless
+// the state says it was already done, and moves it into dir/done or
+// dir/failed. An output still over the target after the retries counts as
+// failed.
+func watchFile(ctx context.Context, r batchReporter, base compress.Options, state *watchState, dir, name, outDir, ext string) error {
+	input := filepath.Join(dir, name)
+	info, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+
+	entry, ok := state.Files[name]
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		output := batchOutput(input, outDir, ext)
+		opts := base
+		opts.Input, opts.Output = input, output
+		followJob(r, &opts)
+		res, err := compress.Compress(ctx, opts)
+		row := summarize(compress.JobResult{Options: opts, Result: res, Err: err})
+		r.jobEnd(row)
+		if row.Status == "cancelled" {
+			return nil
+		}
+
+		entry = watchEntry{Size: info.Size(), ModTime: info.ModTime(), Status: "done", Output: row.Output, Finished: time.Now()}
+		switch row.Status {
+		case "failed":
+			entry.Status, entry.Error = "failed", row.Error
+		case "over target":
+			// The retries could not bring it under the target, so it is not
+			// done; the output is kept for the user to judge.
+			entry.Status = "failed"
+			entry.Error = fmt.Sprintf("output is %.2f MB, over the %g MB target", float64(row.OutputSize)/(1024*1024), opts.TargetMB)
+		}
+		state.Files[name] = entry
+		if err := state.save(); err != nil {
+			return fmt.Errorf("saving watch state: %v", err)
+		}
+	}
+
+	// The state is saved before the move, so a watcher stopped in between
+	// finishes the move on its next run instead of compressing again.
+	if _, err := moveInto(input, filepath.Join(dir, entry.Status)); err != nil {
+		return fmt.Errorf("moving to %s: %v", entry.Status, err)
+	}
+	return nil
+}
+
+// moveInto moves path into dir, adding a number to the name if dir already
+// has a file by that name, and returns the new path.
+func moveInto(path, dir string) (string, error) {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	dest := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dest); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		dest = filepath.Join(dir, fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+	return dest, os.Rename(path, dest)
+}
+
+// loadWatchState reads the state file at path, starting empty if there is
+// none yet.
+func loadWatchState(path string) (*watchState, error) {
+	state := &watchState{path: path, Files: make(map[string]watchEntry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]watchEntry)
+	}
+	return state, nil
+}
+
+func (s *watchState) save() error {
+	return writeJSONFile(s.path, s)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"phergul/mp4_compress/compress"
+	"phergul/mp4_compress/compress/compresstest"
+)
+
+func TestScanWatchDir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string, modTime time.Time) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	write("new.mp4", "video", old.Add(time.Minute))
+	write("old.MKV", "video", old)
+	write("notes.txt", "text", old)
+	write(".hidden.mp4", "video", old)
+	if err := os.Mkdir(filepath.Join(dir, "sub.mp4"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	r := newJSONReporter(io.Discard)
+
+	// Without a settle time videos are ready when first seen, oldest first.
+	if got := scanWatchDir(r, dir, make(map[string]*pendingFile), 0); !slices.Equal(got, []string{"old.MKV", "new.mp4"}) {
+		t.Fatalf("scanWatchDir() = %q, want the two videos, oldest first", got)
+	}
+
+	const settle = time.Minute
+	pending := make(map[string]*pendingFile)
+	if got := scanWatchDir(r, dir, pending, settle); len(got) != 0 {
+		t.Fatalf("first scan = %q, want nothing ready yet", got)
+	}
+	for _, p := range pending {
+		p.since = p.since.Add(-settle)
+	}
+	// new.mp4 is still being written.
+	write("new.mp4", "more video", old.Add(2*time.Minute))
+	if got := scanWatchDir(r, dir, pending, settle); !slices.Equal(got, []string{"old.MKV"}) {
+		t.Fatalf("second scan = %q, want only the video that kept its size", got)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "new.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	scanWatchDir(r, dir, pending, settle)
+	if _, ok := pending["new.mp4"]; ok {
+		t.Error("a removed video is still pending")
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   compresstest.Script
+		retries  int
+		done     bool // the state already has the file as done
+		status   string
+		err      string
+		commands int
+	}{
+		{
+			name:     "compressed",
+			script:   compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 1024},
+			status:   "done",
+			commands: 3,
+		},
+		{
+			name:     "failed",
+			script:   compresstest.Script{Duration: "20.5", Size: 5 << 20, FailPass: -1},
+			status:   "failed",
+			err:      "pass 1",
+			commands: 2,
+		},
+		{
+			name:     "still over the target after retries",
+			script:   compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 3000},
+			retries:  1,
+			status:   "failed",
+			err:      "over the 2 MB target",
+			commands: 4,
+		},
+		{
+			// A watcher stopped between saving the state and moving the
+			// file only moves it when it runs again.
+			name:   "already done",
+			script: compresstest.Script{Duration: "20.5", Size: 5 << 20, OutputKB: 1024},
+			done:   true,
+			status: "done",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, input := compresstest.New(t, tt.script)
+			dir := filepath.Dir(input)
+			outDir := filepath.Join(dir, "compressed")
+			for _, sub := range []string{outDir, filepath.Join(dir, "done"), filepath.Join(dir, "failed")} {
+				if err := os.Mkdir(sub, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			state, err := loadWatchState(filepath.Join(dir, watchStateFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.done {
+				info, err := os.Stat(input)
+				if err != nil {
+					t.Fatal(err)
+				}
+				state.Files["input.mp4"] = watchEntry{Size: info.Size(), ModTime: info.ModTime(), Status: "done"}
+			}
+
+			base := compress.Options{TargetMB: 2, Force: true, MaxRetries: tt.retries, Runner: runner, TempDir: t.TempDir()}
+			if err := watchFile(context.Background(), newJSONReporter(io.Discard), base, state, dir, "input.mp4", outDir, ".mp4"); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, tt.status, "input.mp4")); err != nil {
+				t.Errorf("input was not moved into %s: %v", tt.status, err)
+			}
+			if _, err := os.Stat(input); !os.IsNotExist(err) {
+				t.Errorf("input is still in the watched folder: %v", err)
+			}
+			if got := len(runner.Commands(t)); got != tt.commands {
+				t.Errorf("ran %d commands, want %d", got, tt.commands)
+			}
+			if tt.done {
+				return
+			}
+
+			saved, err := loadWatchState(state.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry := saved.Files["input.mp4"]
+			if entry.Status != tt.status || !strings.Contains(entry.Error, tt.err) || tt.err == "" && entry.Error != "" {
+				t.Errorf("state = %s, %q; want %s, %q", entry.Status, entry.Error, tt.status, tt.err)
+			}
+			if tt.status == "done" && entry.Output != filepath.Join(outDir, "input_compressed.mp4") {
+				t.Errorf("state output = %q", entry.Output)
+			}
+		})
+	}
+}
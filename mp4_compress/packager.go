@@ -1,3 +1,5 @@
+//go:build ignore
+
 package main
 
 import (
@@ -84,6 +86,16 @@ Run: %LOCALAPPDATA%\mp4_compress\uninstall.ps1
 		log.Fatalf("\nERROR: Failed to add internal directory: %v\n", err)
 	}
 
+	if err := addDirToZip(zipWriter, "compress", "compress"); err != nil {
+		log.Fatalf("\nERROR: Failed to add compress directory: %v\n", err)
+	}
+
+	for _, name := range []string{"go.mod", "go.sum"} {
+		if err := addFileToZip(zipWriter, name, name); err != nil {
+			log.Fatalf("\nERROR: Failed to add %s: %v\n", name, err)
+		}
+	}
+
 	fmt.Println(" DONE")
 
 	fmt.Printf("Created at: %s\n", zipPath)
@@ -156,7 +168,7 @@ func buildCompressor() error {
 	}
 
 	fmt.Print("Building mp4_compress.exe...")
-	cmd := exec.Command("go", "build", "-o", compressorBinary, compressorSource)
+	cmd := exec.Command("go", "build", "-o", compressorBinary, "./internal")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		fmt.Println(" FAILED")